@@ -0,0 +1,91 @@
+package raftylog
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// ChecksumAlgorithm identifies the algorithm used to hash each entry in a segment. The
+// algorithm is recorded in each segment's header, so changing Config.Checksum only affects
+// new segments, existing segments continue to be read using the algorithm they were
+// written with.
+type ChecksumAlgorithm uint8
+
+const (
+	// ChecksumDefault selects the default algorithm for new segments, currently CRC32C.
+	ChecksumDefault ChecksumAlgorithm = iota
+	// ChecksumFNV64 is the 64 bit FNV-1 hash, used by segments written by older versions.
+	ChecksumFNV64
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, its hardware accelerated on amd64 & arm64.
+	ChecksumCRC32C
+	// ChecksumXXHash64 is the 64 bit xxHash.
+	ChecksumXXHash64
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumDefault:
+		return "Default"
+	case ChecksumFNV64:
+		return "FNV64"
+	case ChecksumCRC32C:
+		return "CRC32C"
+	case ChecksumXXHash64:
+		return "XXHash64"
+	}
+	return fmt.Sprintf("ChecksumAlgorithm(%d)", uint8(a))
+}
+
+// Checksum calculates the hash that's stored with each entry in a segment.
+type Checksum interface {
+	Algorithm() ChecksumAlgorithm
+	Sum64(data []byte) uint64
+}
+
+// checksumFor returns the Checksum implementation of the algorithm a.
+func checksumFor(a ChecksumAlgorithm) (Checksum, error) {
+	switch a {
+	case ChecksumDefault, ChecksumCRC32C:
+		return crc32cChecksum{}, nil
+	case ChecksumFNV64:
+		return fnv64Checksum{}, nil
+	case ChecksumXXHash64:
+		return xxhash64Checksum{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported checksum algorithm %v", a)
+}
+
+type fnv64Checksum struct{}
+
+func (fnv64Checksum) Algorithm() ChecksumAlgorithm {
+	return ChecksumFNV64
+}
+
+func (fnv64Checksum) Sum64(data []byte) uint64 {
+	h := fnv.New64()
+	h.Write(data)
+	return h.Sum64()
+}
+
+type crc32cChecksum struct{}
+
+func (crc32cChecksum) Algorithm() ChecksumAlgorithm {
+	return ChecksumCRC32C
+}
+
+func (crc32cChecksum) Sum64(data []byte) uint64 {
+	return uint64(crc32.Checksum(data, castagnoli))
+}
+
+type xxhash64Checksum struct{}
+
+func (xxhash64Checksum) Algorithm() ChecksumAlgorithm {
+	return ChecksumXXHash64
+}
+
+func (xxhash64Checksum) Sum64(data []byte) uint64 {
+	return xxhash.Sum64(data)
+}
@@ -0,0 +1,137 @@
+package raftylog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_ChecksumAlgorithms(t *testing.T) {
+	data := []byte("hello raftylog")
+	for _, a := range []ChecksumAlgorithm{ChecksumFNV64, ChecksumCRC32C, ChecksumXXHash64} {
+		c, err := checksumFor(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Algorithm() != a {
+			t.Errorf("checksumFor(%v) returned %v", a, c.Algorithm())
+		}
+		if c.Sum64(data) != c.Sum64(append([]byte(nil), data...)) {
+			t.Errorf("%v isn't deterministic", a)
+		}
+		if c.Sum64(data) == c.Sum64([]byte("hello raftyloh")) {
+			t.Errorf("%v didn't detect a changed byte", a)
+		}
+	}
+	c, err := checksumFor(ChecksumDefault)
+	if err != nil || c.Algorithm() != ChecksumCRC32C {
+		t.Errorf("Default checksum should be CRC32C, got %v %v", c, err)
+	}
+	if _, err := checksumFor(ChecksumAlgorithm(99)); err == nil {
+		t.Errorf("Unknown algorithm should fail")
+	}
+}
+
+func Test_LogMixedChecksums(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	index := Index(1)
+	algorithms := []ChecksumAlgorithm{ChecksumFNV64, ChecksumDefault, ChecksumXXHash64, ChecksumCRC32C}
+	// each time the log is opened with a different algorithm, existing segments keep theirs.
+	for _, a := range algorithms {
+		log, err := Open(dir, &Config{MaxSegmentItems: 4, Checksum: a}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 6; i++ {
+			if _, err := log.Append([]byte(fmt.Sprintf("entry %d", index))); err != nil {
+				t.Fatal(err)
+			}
+			index++
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err := Open(dir, &Config{Checksum: ChecksumFNV64}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	seen := map[ChecksumAlgorithm]bool{}
+	for _, seg := range log.items {
+		seen[seg.header.checksum] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expecting segments with 3 different checksum algorithms, but got %v", seen)
+	}
+	for i := Index(1); i < index; i++ {
+		d, err := log.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := []byte(fmt.Sprintf("entry %d", i)); !bytes.Equal(d, exp) {
+			t.Errorf("Unexpected data %q for index %d", d, i)
+		}
+	}
+}
+
+func benchmarkChecksum(b *testing.B, a ChecksumAlgorithm) {
+	c, err := checksumFor(a)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{64, 4096, 1024 * 1024} {
+		data := bytes.Repeat([]byte{0xA5}, size)
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				c.Sum64(data)
+			}
+		})
+	}
+}
+
+func Benchmark_ChecksumFNV64(b *testing.B) {
+	benchmarkChecksum(b, ChecksumFNV64)
+}
+
+func Benchmark_ChecksumCRC32C(b *testing.B) {
+	benchmarkChecksum(b, ChecksumCRC32C)
+}
+
+func Benchmark_ChecksumXXHash64(b *testing.B) {
+	benchmarkChecksum(b, ChecksumXXHash64)
+}
+
+func Test_LogInvalidAlgorithms(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	bad := []Config{{Checksum: 99}, {Compression: 99}, {SegmentCompression: 99}}
+	for _, cfg := range bad {
+		if _, err := Open(dir, &cfg, true); err == nil {
+			t.Errorf("Open with invalid config %+v should fail", cfg)
+		}
+	}
+	for _, cfg := range bad[:2] {
+		if _, err := newSegment(dir, &cfg, 1); err == nil {
+			t.Errorf("newSegment with invalid config %+v should fail", cfg)
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Invalid configs shouldn't create any files, got %v", files)
+	}
+	log, err := Open(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if _, err := log.Append([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,360 @@
+// Command raftylog inspects and maintains raftylog log directories.
+//
+//	raftylog ls [-keys file] <dir>                         list the segments
+//	raftylog stat [-keys file] <dir>                       summarize the log
+//	raftylog dump [flags] <dir>                            print entries
+//	raftylog verify [-decode] [-keys file] <dir>           check every entry's checksum
+//	raftylog truncate-before [-keys file] <dir> <index>    delete the segments entirely before index
+//	raftylog truncate-after [-keys file] <dir> <index>     delete the entries after index
+//
+// None of the commands can be used while the log is open for writing. ls, stat & dump open
+// the log read only, so they can be run alongside other read only users of the log.
+//
+// An encrypted log needs its keys, which are read from the file given by -keys. Each line of
+// the file is a key id followed by the hex encoded key, blank lines and lines starting with
+// # are ignored. verify can check the entries' hashes without the keys, they're only needed
+// with -decode.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/superfell/raftylog"
+)
+
+const usage = `usage: raftylog <command> [flags] <dir> [args]
+
+commands:
+  ls [-keys file] <dir>                         list the segments
+  stat [-keys file] <dir>                       summarize the log
+  dump [flags] <dir>                            print entries, see raftylog dump -h
+  verify [-decode] [-keys file] <dir>           check every entry's checksum
+  truncate-before [-keys file] <dir> <index>    delete the segments entirely before index
+  truncate-after [-keys file] <dir> <index>     delete the entries after index
+`
+
+// errUsage is returned for invalid arguments, after the usage has been printed.
+var errUsage = errors.New("invalid arguments")
+
+// errVerifyFailed is returned by verify when problems are found.
+var errVerifyFailed = errors.New("log failed verification")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case err == nil || err == flag.ErrHelp:
+	case err == errUsage:
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command in args, writing its output to stdout.
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	cmds := map[string]func(args []string, stdout, stderr io.Writer) error{
+		"ls":              ls,
+		"stat":            stat,
+		"dump":            dump,
+		"verify":          verify,
+		"truncate-before": truncateBefore,
+		"truncate-after":  truncateAfter,
+	}
+	cmd := cmds[args[0]]
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return errUsage
+	}
+	return cmd(args[1:], stdout, stderr)
+}
+
+// parse parses the flags of a command and checks the number of remaining args.
+func parse(fs *flag.FlagSet, args []string, nargs int, argUsage string, stderr io.Writer) ([]string, error) {
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: raftylog %s %s\n", fs.Name(), argUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// keysFlag adds the -keys flag to fs.
+func keysFlag(fs *flag.FlagSet) *string {
+	return fs.String("keys", "", "read the keys of an encrypted log from `file`, each line is a key id and the hex encoded key")
+}
+
+// loadKeys reads the keys file fn, it returns nil if fn is empty.
+func loadKeys(fn string) (raftylog.KeyProvider, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	keys := &raftylog.StaticKeys{Keys: make(map[string][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d of %v should be a key id and the hex encoded key", i+1, fn)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of %v has an invalid key: %v", i+1, fn, err)
+		}
+		keys.Keys[fields[0]] = key
+	}
+	return keys, nil
+}
+
+// openLog opens the log in dir with the keys from keysFile.
+func openLog(dir, keysFile string, readOnly bool) (*raftylog.Log, error) {
+	keys, err := loadKeys(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	return raftylog.Open(dir, &raftylog.Config{ReadOnly: readOnly, Keys: keys}, false)
+}
+
+func ls(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 1, "[-keys file] <dir>", stderr)
+	if err != nil {
+		return err
+	}
+	log, err := openLog(args[0], *keys, true)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	segs, err := log.Segments()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tFIRST\tLAST\tENTRIES\tSIZE\tSTATE")
+	for _, s := range segs {
+		state := "open"
+		if s.Sealed {
+			state = "sealed"
+		}
+		if s.Compressed {
+			state += ",compressed"
+		}
+		if s.Encrypted {
+			state += ",encrypted"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", s.Filename, s.FirstIndex, s.LastIndex, s.LastIndex+1-s.FirstIndex, s.Size, state)
+	}
+	return w.Flush()
+}
+
+func stat(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 1, "[-keys file] <dir>", stderr)
+	if err != nil {
+		return err
+	}
+	log, err := openLog(args[0], *keys, true)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	segs, err := log.Segments()
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	for _, s := range segs {
+		size += s.Size
+	}
+	first, last := log.FirstIndex(), log.LastIndex()
+	entries := uint64(0)
+	if last >= first && last > 0 {
+		entries = uint64(last - first + 1)
+	}
+	fmt.Fprintf(stdout, "first index: %d\nlast index:  %d\nentries:     %d\nsegments:    %d\nbytes:       %d\n", first, last, entries, len(segs), size)
+	return nil
+}
+
+// dumpEntry is an entry as written by dump -format json.
+type dumpEntry struct {
+	Index      raftylog.Index `json:"index"`
+	Term       uint64         `json:"term,omitempty"`
+	Type       string         `json:"type,omitempty"`
+	AppendedAt *time.Time     `json:"appendedAt,omitempty"`
+	Data       []byte         `json:"data"`
+}
+
+func dump(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "first index to print, defaults to the first index in the log")
+	to := fs.Uint64("to", 0, "last index to print, defaults to the last index in the log")
+	format := fs.String("format", "hex", "how to print the entry data, one of hex, base64 or json")
+	raftMode := fs.Bool("raft", false, "decode entries as raft logs written with the default codec, showing their term, type & appended at time")
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 1, "[flags] <dir>", stderr)
+	if err != nil {
+		return err
+	}
+	encode := map[string]func([]byte) string{
+		"hex":    hex.EncodeToString,
+		"base64": base64.StdEncoding.EncodeToString,
+		"json":   nil,
+	}
+	enc, ok := encode[*format]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown format %q\n", *format)
+		fs.Usage()
+		return errUsage
+	}
+	log, err := openLog(args[0], *keys, true)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	first, last := raftylog.Index(*from), raftylog.Index(*to)
+	if first == 0 {
+		first = log.FirstIndex()
+	}
+	if last == 0 {
+		last = log.LastIndex()
+	}
+	codec := raftylog.BinaryCodec{}
+	out := json.NewEncoder(stdout)
+	it := log.Iterator(first, last)
+	for it.Next() {
+		e := dumpEntry{Index: it.Index(), Data: it.Value()}
+		if *raftMode {
+			var l raft.Log
+			if err := codec.Decode(it.Value(), &l); err != nil {
+				return fmt.Errorf("Entry %d isn't a raft log: %v", it.Index(), err)
+			}
+			e.Term, e.Type, e.Data = l.Term, l.Type.String(), l.Data
+			if !l.AppendedAt.IsZero() {
+				e.AppendedAt = &l.AppendedAt
+			}
+		}
+		if enc == nil {
+			if err := out.Encode(&e); err != nil {
+				return err
+			}
+			continue
+		}
+		if *raftMode {
+			appended := "-"
+			if e.AppendedAt != nil {
+				appended = e.AppendedAt.Format(time.RFC3339Nano)
+			}
+			_, err = fmt.Fprintf(stdout, "%d term=%d type=%s appended=%s %s\n", e.Index, e.Term, e.Type, appended, enc(e.Data))
+		} else {
+			_, err = fmt.Fprintf(stdout, "%d %s\n", e.Index, enc(e.Data))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func verify(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	decode := fs.Bool("decode", false, "also decrypt & decompress every entry")
+	keysFile := keysFlag(fs)
+	args, err := parse(fs, args, 1, "[-decode] [-keys file] <dir>", stderr)
+	if err != nil {
+		return err
+	}
+	keys, err := loadKeys(*keysFile)
+	if err != nil {
+		return err
+	}
+	report, err := raftylog.VerifyDir(context.Background(), args[0], raftylog.VerifyOptions{Decode: *decode, Keys: keys})
+	if err != nil {
+		return err
+	}
+	for _, s := range report.Segments {
+		switch {
+		case s.Err != nil && s.BadIndex != 0:
+			fmt.Fprintf(stdout, "%s: bad entry at index %d: %v\n", s.Segment, s.BadIndex, s.Err)
+		case s.Err != nil:
+			fmt.Fprintf(stdout, "%s: %v\n", s.Segment, s.Err)
+		case s.BadSidecar:
+			fmt.Fprintf(stdout, "%s: sidecar index doesn't match the segment\n", s.Segment)
+		default:
+			fmt.Fprintf(stdout, "%s: ok\n", s.Segment)
+		}
+	}
+	for _, g := range report.Gaps {
+		fmt.Fprintf(stdout, "%v\n", g)
+	}
+	if !report.OK() {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// truncate opens the log in args for writing and passes it & the index in args to fn.
+func truncate(name string, args []string, stderr io.Writer, fn func(log *raftylog.Log, idx raftylog.Index) error) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 2, "[-keys file] <dir> <index>", stderr)
+	if err != nil {
+		return err
+	}
+	idx, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid index %q: %v", args[1], err)
+	}
+	log, err := openLog(args[0], *keys, false)
+	if err != nil {
+		return err
+	}
+	if err := fn(log, raftylog.Index(idx)); err != nil {
+		log.Close()
+		return err
+	}
+	return log.Close()
+}
+
+func truncateBefore(args []string, stdout, stderr io.Writer) error {
+	return truncate("truncate-before", args, stderr, func(log *raftylog.Log, idx raftylog.Index) error {
+		return log.DeleteTo(idx)
+	})
+}
+
+func truncateAfter(args []string, stdout, stderr io.Writer) error {
+	return truncate("truncate-after", args, stderr, func(log *raftylog.Log, idx raftylog.Index) error {
+		return log.RewindTo(idx + 1)
+	})
+}
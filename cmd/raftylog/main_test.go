@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/superfell/raftylog"
+)
+
+// testLog writes a raft log with entries 1-25 to a temp directory.
+func testLog(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "raftylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, err := raftylog.OpenLog(dir, &raftylog.Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended := time.Date(2021, 12, 1, 10, 0, 0, 0, time.UTC)
+	for i := uint64(1); i <= 25; i++ {
+		l := raft.Log{Index: i, Term: 1 + i/10, Type: raft.LogCommand, Data: []byte{byte(i)}, AppendedAt: appended}
+		if err := log.StoreLog(&l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func runCmd(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func Test_Commands(t *testing.T) {
+	dir := testLog(t)
+	out, err := runCmd(t, "ls", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[1], "00000000000000000001-00000000000000000010.seg") || !strings.Contains(lines[1], "sealed") {
+		t.Errorf("Unexpected ls output\n%s", out)
+	}
+
+	out, err = runCmd(t, "stat", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "first index: 1\n") || !strings.Contains(out, "last index:  25\n") || !strings.Contains(out, "entries:     25\n") {
+		t.Errorf("Unexpected stat output\n%s", out)
+	}
+
+	out, err = runCmd(t, "dump", "-from", "3", "-to", "4", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "3 ") {
+		t.Errorf("Unexpected dump output\n%s", out)
+	}
+	out, err = runCmd(t, "dump", "-raft", "-format", "json", "-from", "12", "-to", "12", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e dumpEntry
+	if err := json.Unmarshal([]byte(out), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Index != 12 || e.Term != 2 || e.Type != "LogCommand" || e.AppendedAt == nil || !bytes.Equal(e.Data, []byte{12}) {
+		t.Errorf("Unexpected raft dump %s", out)
+	}
+
+	if out, err = runCmd(t, "verify", dir); err != nil {
+		t.Errorf("Verify failed %v\n%s", err, out)
+	}
+
+	if _, err := runCmd(t, "truncate-before", dir, "15"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCmd(t, "truncate-after", dir, "20"); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runCmd(t, "stat", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "first index: 11\n") || !strings.Contains(out, "last index:  20\n") {
+		t.Errorf("Unexpected stat output after truncation\n%s", out)
+	}
+
+	if _, err := runCmd(t, "bogus", dir); err != errUsage {
+		t.Errorf("Unknown command should fail with usage, got %v", err)
+	}
+	if _, err := runCmd(t, "truncate-after", dir); err != errUsage {
+		t.Errorf("Missing index should fail with usage, got %v", err)
+	}
+}
+
+func Test_CommandsEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := bytes.Repeat([]byte{7}, 32)
+	keys := &raftylog.StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": key}}
+	cfg := raftylog.Config{MaxSegmentItems: 10, Encryption: raftylog.EncryptionAESGCM, Keys: keys}
+	log, err := raftylog.Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 15; i++ {
+		if _, err := log.Append([]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keysFile := path.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysFile, []byte("# test keys\nk1 "+hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runCmd(t, "ls", dir); err == nil {
+		t.Errorf("ls of an encrypted log without its keys should fail")
+	}
+	out, err := runCmd(t, "ls", "-keys", keysFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 || !strings.Contains(lines[1], "sealed,encrypted") {
+		t.Errorf("Unexpected ls output\n%s", out)
+	}
+	out, err = runCmd(t, "dump", "-keys", keysFile, "-from", "12", "-to", "12", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "12 0c\n" {
+		t.Errorf("Unexpected dump output %q", out)
+	}
+	if out, err = runCmd(t, "verify", "-decode", dir); err != errVerifyFailed {
+		t.Errorf("Decoding without the keys should fail verification, got %v\n%s", err, out)
+	}
+	if out, err = runCmd(t, "verify", "-decode", "-keys", keysFile, dir); err != nil {
+		t.Errorf("Verify failed %v\n%s", err, out)
+	}
+}
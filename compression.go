@@ -0,0 +1,148 @@
+package raftylog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionAlgorithm identifies the algorithm used to compress entries. Each entry
+// records how it was compressed, so changing Config.Compression only affects entries
+// appended after the change, existing entries continue to be readable.
+type CompressionAlgorithm uint8
+
+const (
+	// CompressionNone stores entries as is.
+	CompressionNone CompressionAlgorithm = iota
+	// CompressionSnappy uses the snappy block format.
+	CompressionSnappy
+	// CompressionS2 uses S2, a faster extension of snappy with better compression.
+	CompressionS2
+	// CompressionZstd uses zstandard, slower than S2 but usually compresses much better.
+	CompressionZstd
+)
+
+func (a CompressionAlgorithm) String() string {
+	switch a {
+	case CompressionNone:
+		return "None"
+	case CompressionSnappy:
+		return "Snappy"
+	case CompressionS2:
+		return "S2"
+	case CompressionZstd:
+		return "Zstd"
+	}
+	return fmt.Sprintf("CompressionAlgorithm(%d)", uint8(a))
+}
+
+// compressor compresses & decompresses individual entries.
+type compressor interface {
+	// compress returns the compressed form of src, it may use dst's storage.
+	compress(dst, src []byte) []byte
+	decompress(src []byte) ([]byte, error)
+}
+
+// compressorFor returns the compressor of the algorithm a, nil for CompressionNone.
+func compressorFor(a CompressionAlgorithm) (compressor, error) {
+	switch a {
+	case CompressionNone:
+		return nil, nil
+	case CompressionSnappy:
+		return snappyCompressor{}, nil
+	case CompressionS2:
+		return s2Compressor{}, nil
+	case CompressionZstd:
+		return zstdCompressor{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression algorithm %v", a)
+}
+
+// compressEntry returns the data to store for the entry d along with the frame flags
+// describing it. Entries are only stored compressed if that makes them smaller.
+func compressEntry(c compressor, a CompressionAlgorithm, minSize int, dst, d []byte) ([]byte, byte) {
+	if c == nil || len(d) < minSize || len(d) == 0 {
+		return d, 0
+	}
+	z := c.compress(dst, d)
+	if len(z) >= len(d) {
+		return d, 0
+	}
+	return z, byte(a)
+}
+
+// decompressEntry returns the entry stored in data of a frame with the supplied flags.
+func decompressEntry(flags byte, data []byte) ([]byte, error) {
+	if flags&^frameCompressionMask != 0 {
+		return nil, fmt.Errorf("unsupported frame flags %x", flags)
+	}
+	c, err := compressorFor(CompressionAlgorithm(flags & frameCompressionMask))
+	if err != nil || c == nil {
+		return data, err
+	}
+	return c.decompress(data)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(dst, src []byte) []byte {
+	return s2.EncodeSnappy(encodeBuffer(dst, src), src)
+}
+
+func (snappyCompressor) decompress(src []byte) ([]byte, error) {
+	// s2 reads snappy blocks
+	return s2.Decode(nil, src)
+}
+
+type s2Compressor struct{}
+
+func (s2Compressor) compress(dst, src []byte) []byte {
+	return s2.Encode(encodeBuffer(dst, src), src)
+}
+
+func (s2Compressor) decompress(src []byte) ([]byte, error) {
+	return s2.Decode(nil, src)
+}
+
+// encodeBuffer returns dst if its large enough for s2 to encode src into.
+func encodeBuffer(dst, src []byte) []byte {
+	n := s2.MaxEncodedLen(len(src))
+	if n < 0 || cap(dst) < n {
+		return nil
+	}
+	return dst[:n]
+}
+
+// The zstd encoder & decoder are expensive to create, but safe for concurrent use by
+// EncodeAll & DecodeAll, so they're shared by all logs.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			panic(err)
+		}
+		if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+			panic(err)
+		}
+	})
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) compress(dst, src []byte) []byte {
+	initZstd()
+	return zstdEncoder.EncodeAll(src, dst[:0])
+}
+
+func (zstdCompressor) decompress(src []byte) ([]byte, error) {
+	initZstd()
+	return zstdDecoder.DecodeAll(src, nil)
+}
@@ -0,0 +1,208 @@
+package raftylog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testEntries returns a mix of small, compressible and incompressible entries.
+func testEntries(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(42))
+	entries := make([][]byte, n)
+	for i := range entries {
+		switch i % 3 {
+		case 0:
+			entries[i] = []byte{byte(i)}
+		case 1:
+			entries[i] = bytes.Repeat([]byte(fmt.Sprintf("entry %d ", i)), 50)
+		case 2:
+			entries[i] = make([]byte, 300)
+			rnd.Read(entries[i])
+		}
+	}
+	return entries
+}
+
+func Test_LogCompression(t *testing.T) {
+	algs := []CompressionAlgorithm{CompressionNone, CompressionSnappy, CompressionS2, CompressionZstd}
+	for _, alg := range algs {
+		for _, mmap := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v_mmap_%t", alg, mmap), func(t *testing.T) {
+				dir, cleanup := testDir(t)
+				defer cleanup()
+				cfg := Config{MaxSegmentItems: 10, Compression: alg, CompressionMinSize: 16, Mmap: mmap}
+				log, err := Open(dir, &cfg, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries := testEntries(25)
+				if _, _, err := log.AppendBatch(entries); err != nil {
+					t.Fatal(err)
+				}
+				check := func(log *Log) {
+					for i, exp := range entries {
+						act, err := log.Read(Index(i + 1))
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !bytes.Equal(exp, act) {
+							t.Errorf("Entry %d didn't round trip", i+1)
+						}
+					}
+				}
+				check(log)
+				compressed := 0
+				seg := log.items[0]
+				for i := range entries[:10] {
+					body, err := seg.readFrame(seg.offsets[i])
+					if err != nil {
+						t.Fatal(err)
+					}
+					if flags := body[0]; flags != 0 {
+						compressed++
+						if CompressionAlgorithm(flags) != alg {
+							t.Errorf("Entry %d has unexpected flags %x", i+1, flags)
+						}
+					}
+				}
+				if exp := map[bool]int{false: 0, true: 3}[alg != CompressionNone]; compressed != exp {
+					t.Errorf("%d entries compressed, expecting %d", compressed, exp)
+				}
+				if err := log.Close(); err != nil {
+					t.Fatal(err)
+				}
+				// entries are readable regardless of the current config
+				log, err = Open(dir, &Config{Compression: CompressionZstd}, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer log.Close()
+				check(log)
+			})
+		}
+	}
+}
+
+func Test_LogCompressionCorrupt(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	seg, err := newSegment(dir, &Config{Compression: CompressionS2}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := bytes.Repeat([]byte("abc"), 100)
+	write(t, seg, entry, 1)
+	write(t, seg, entry, 2)
+	defer seg.reader.close()
+
+	// the hash covers the compressed data
+	offset := seg.reader.offsets[0] + 10
+	if _, err := seg.reader.f.WriteAt([]byte{0xff}, offset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.reader.read(1); err == nil || !strings.Contains(err.Error(), "invalid hash") {
+		t.Errorf("Expecting hash error, got %v", err)
+	}
+	// unknown flags are rejected rather than misread
+	frame := appendFrame(nil, currentSegmentVersion, 0x40, entry, seg.reader.checksum)
+	if _, err := seg.reader.f.WriteAt(frame, seg.reader.offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.reader.read(2); err == nil || !strings.Contains(err.Error(), "unsupported frame flags") {
+		t.Errorf("Expecting flags error, got %v", err)
+	}
+	if _, err := newSegment(dir, &Config{Compression: 42}, 10); err == nil {
+		t.Errorf("Unknown compression algorithm should fail")
+	}
+}
+
+// writeV1Segment writes a segment in the version 1 format, which has no frame flags.
+func writeV1Segment(t *testing.T, dir string, first Index, entries [][]byte) string {
+	h := newSegmentHeader(first, ChecksumCRC32C, CompressionNone)
+	h.version = segmentVersion1
+	b := h.marshal()
+	for _, e := range entries {
+		b = appendFrame(b, segmentVersion1, 0, e, crc32cChecksum{})
+	}
+	fn := fmt.Sprintf("%020d-%020d.seg", first, first+Index(len(entries))-1)
+	if err := ioutil.WriteFile(path.Join(dir, fn), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func Test_LogReadsV1Segments(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := testEntries(6)
+	fn := writeV1Segment(t, dir, 1, entries)
+	info, err := os.Stat(path.Join(dir, fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := int64(segmentHeaderV1Len)
+	for _, e := range entries {
+		exp += int64(4 + len(e) + 8)
+	}
+	if info.Size() != exp {
+		t.Errorf("Unexpected v1 segment size %d, expecting %d", info.Size(), exp)
+	}
+	log, err := Open(dir, &Config{Compression: CompressionSnappy}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	more := testEntries(3)
+	if _, _, err := log.AppendBatch(more); err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries, more...)
+	for i, exp := range entries {
+		act, err := log.Read(Index(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(exp, act) {
+			t.Errorf("Entry %d didn't round trip", i+1)
+		}
+	}
+	if v := log.items[1].header.version; v != currentSegmentVersion {
+		t.Errorf("New segment has version %d", v)
+	}
+}
+
+func benchmarkCompression(b *testing.B, alg CompressionAlgorithm) {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := Open(dir, &Config{Compression: alg, Sync: SyncNever}, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer log.Close()
+	entry := bytes.Repeat([]byte("some raft command "), 32)
+	b.SetBytes(int64(len(entry)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx, err := log.Append(entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := log.Read(idx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_CompressionNone(b *testing.B)   { benchmarkCompression(b, CompressionNone) }
+func Benchmark_CompressionSnappy(b *testing.B) { benchmarkCompression(b, CompressionSnappy) }
+func Benchmark_CompressionS2(b *testing.B)     { benchmarkCompression(b, CompressionS2) }
+func Benchmark_CompressionZstd(b *testing.B)   { benchmarkCompression(b, CompressionZstd) }
@@ -0,0 +1,230 @@
+package raftylog
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SegmentCheckMode controls what Open does when the segments in the log directory don't
+// form a contiguous range of indexes, e.g. because a segment file is missing, or there are
+// overlapping segments left by an interrupted RewindTo or by files being copied by hand.
+type SegmentCheckMode int
+
+const (
+	// SegmentCheckStrict fails Open with a *NonContiguousError, or if the last sealed
+	// segment has fewer entries than its filename says, an error wrapping
+	// ErrNonContiguousSegments.
+	SegmentCheckStrict SegmentCheckMode = iota
+	// SegmentCheckLenient repairs the log. A last sealed segment with fewer entries than its
+	// filename says is renamed to match its contents. Where segments overlap the later
+	// starting segment wins, as it would after a RewindTo, and the earlier segment is
+	// truncated to end just before it, or removed if it starts at the same index. If that
+	// leaves any gaps, only the segments after the last gap are kept. Each change is reported
+	// to Config.OnSegmentRepair. Read only logs can't be repaired, so Open still fails.
+	SegmentCheckLenient
+)
+
+func (m SegmentCheckMode) String() string {
+	switch m {
+	case SegmentCheckStrict:
+		return "Strict"
+	case SegmentCheckLenient:
+		return "Lenient"
+	}
+	return fmt.Sprintf("SegmentCheckMode(%d)", int(m))
+}
+
+// SegmentGap describes two adjacent segments whose index ranges don't join up. If
+// NextFirst is greater than PrevLast+1 there's a gap between them, otherwise they overlap.
+type SegmentGap struct {
+	Prev      string // filename of the earlier segment
+	PrevLast  Index  // last index of the earlier segment
+	Next      string // filename of the later segment
+	NextFirst Index  // first index of the later segment
+}
+
+func (g SegmentGap) String() string {
+	if g.NextFirst > g.PrevLast+1 {
+		return fmt.Sprintf("indexes %d-%d are missing between %v and %v", g.PrevLast+1, g.NextFirst-1, g.Prev, g.Next)
+	}
+	return fmt.Sprintf("indexes %d-%d are in both %v and %v", g.NextFirst, g.PrevLast, g.Prev, g.Next)
+}
+
+// NonContiguousError is returned by Open when the log's segments don't form a contiguous
+// range of indexes. errors.Is reports it as ErrNonContiguousSegments.
+type NonContiguousError struct {
+	Gaps []SegmentGap
+}
+
+func (e *NonContiguousError) Error() string {
+	s := make([]string, len(e.Gaps))
+	for i, g := range e.Gaps {
+		s[i] = g.String()
+	}
+	return fmt.Sprintf("%v: %v", ErrNonContiguousSegments, strings.Join(s, ", "))
+}
+
+func (e *NonContiguousError) Is(target error) bool {
+	return target == ErrNonContiguousSegments
+}
+
+// SegmentRepair describes a change made to a segment by Open in SegmentCheckLenient mode.
+type SegmentRepair struct {
+	Segment string // filename of the segment, before it was changed
+	Removed bool   // true if the whole segment was removed, otherwise it was truncated
+	From    Index  // first index discarded from the segment
+	To      Index  // last index discarded from the segment
+	Reason  string
+}
+
+// checkContiguous checks that log.items, sorted by their first index, form a contiguous
+// range of indexes, repairing them according to Config.SegmentCheck.
+func (log *Log) checkContiguous() error {
+	var gaps []SegmentGap
+	for i := 1; i < len(log.items); i++ {
+		prev, next := log.items[i-1], log.items[i]
+		if next.firstIndex != prev.lastIndex+1 {
+			gaps = append(gaps, SegmentGap{Prev: prev.filename, PrevLast: prev.lastIndex, Next: next.filename, NextFirst: next.firstIndex})
+		}
+	}
+	if len(gaps) == 0 {
+		return nil
+	}
+	if log.config.SegmentCheck != SegmentCheckLenient || log.config.ReadOnly {
+		return &NonContiguousError{Gaps: gaps}
+	}
+	return log.repairSegments()
+}
+
+// reportRepair reports a change made by SegmentCheckLenient to Config.OnSegmentRepair.
+func (log *Log) reportRepair(r SegmentRepair) {
+	if log.config.OnSegmentRepair != nil {
+		log.config.OnSegmentRepair(r)
+	}
+}
+
+// checkLastSealed checks that the last sealed segment contains the entries its filename
+// says it does. A crash part way through a rewind by an older version could leave it
+// truncated without being renamed. With SegmentCheckLenient the segment is renamed to
+// match its contents, otherwise Open fails.
+func (log *Log) checkLastSealed() error {
+	i := len(log.items) - 1
+	for i >= 0 && !log.items[i].sealed() {
+		i--
+	}
+	if i < 0 || log.items[i].compressed() {
+		// a block compressed segment's entries are checked when its opened.
+		return nil
+	}
+	seg := log.items[i]
+	want := int(seg.lastIndex - seg.firstIndex + 1)
+	info, err := seg.f.Stat()
+	if err != nil {
+		return err
+	}
+	if offsets, _, err := readIndexFile(path.Join(log.dir, indexFilename(seg.filename)), info.Size()); err == nil && len(offsets) == want {
+		return nil
+	}
+	offsets, err := seg.scanOffsets()
+	if err != nil {
+		return err
+	}
+	if len(offsets) == want {
+		seg.offsets = offsets
+		return nil
+	}
+	if log.config.SegmentCheck != SegmentCheckLenient || log.config.ReadOnly || len(offsets) > want {
+		return fmt.Errorf("%w: segment %v contains %d entries, expecting %d", ErrNonContiguousSegments, seg.filename, len(offsets), want)
+	}
+	have := seg.firstIndex + Index(len(offsets)) - 1
+	r := SegmentRepair{Segment: seg.filename, From: have + 1, To: seg.lastIndex,
+		Reason: fmt.Sprintf("only contains %d entries", len(offsets))}
+	if len(offsets) == 0 {
+		r.Removed = true
+		log.items = append(log.items[:i], log.items[i+1:]...)
+		if err := log.removeSegment(seg); err != nil {
+			return err
+		}
+		log.reportRepair(r)
+		return nil
+	}
+	if err := seg.removeIndexFile(); err != nil {
+		return err
+	}
+	if err := seg.munmap(); err != nil {
+		return err
+	}
+	seg.offsets = offsets
+	seg.lastIndex = have
+	seg.keys = nil
+	if err := seg.rename(fmt.Sprintf("%020d-%020d.seg", seg.firstIndex, seg.lastIndex)); err != nil {
+		return err
+	}
+	log.reportRepair(r)
+	return seg.mmap()
+}
+
+// repairSegments makes log.items contiguous as described for SegmentCheckLenient.
+func (log *Log) repairSegments() error {
+	report := log.reportRepair
+	items := log.items
+	log.items = make([]*segmentReader, 0, len(items))
+	for i, seg := range items {
+		for len(log.items) > 0 {
+			prev := log.items[len(log.items)-1]
+			if seg.firstIndex > prev.lastIndex {
+				break
+			}
+			r := SegmentRepair{Segment: prev.filename, From: seg.firstIndex, To: prev.lastIndex,
+				Reason: fmt.Sprintf("overlaps with %v", seg.filename)}
+			if seg.firstIndex <= prev.firstIndex {
+				r.Removed, r.From = true, prev.firstIndex
+				log.items = log.items[:len(log.items)-1]
+				if err := log.removeSegment(prev); err != nil {
+					log.items = append(log.items, items[i:]...)
+					return err
+				}
+				report(r)
+				continue
+			}
+			trimmed, err := log.truncateSegment(prev, seg.firstIndex)
+			log.items[len(log.items)-1] = trimmed
+			if err != nil {
+				log.items = append(log.items, items[i:]...)
+				return err
+			}
+			report(r)
+		}
+		log.items = append(log.items, seg)
+	}
+	start := 0
+	for i := 1; i < len(log.items); i++ {
+		if log.items[i].firstIndex != log.items[i-1].lastIndex+1 {
+			start = i
+		}
+	}
+	for start > 0 {
+		seg := log.items[0]
+		log.items = log.items[1:]
+		start--
+		r := SegmentRepair{Segment: seg.filename, Removed: true, From: seg.firstIndex, To: seg.lastIndex,
+			Reason: fmt.Sprintf("before a gap, the log now starts at index %d", log.items[start].firstIndex)}
+		if err := log.removeSegment(seg); err != nil {
+			return err
+		}
+		report(r)
+	}
+	return log.syncDir()
+}
+
+// removeSegment removes a segment that repairSegments has discarded, moving it to the
+// quarantine directory when run by Repair.
+func (log *Log) removeSegment(s *segmentReader) error {
+	if log.config.quarantineDir == "" {
+		return s.delete()
+	}
+	err := s.close()
+	_, err2 := quarantineSegment(log.dir, s.filename, log.config.quarantineDir)
+	return any(err2, err)
+}
@@ -0,0 +1,199 @@
+package raftylog
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// writeTestLog writes entries to a new log in dir, and closes it.
+func writeTestLog(t *testing.T, dir string, cfg *Config, entries [][]byte) {
+	t.Helper()
+	log, err := Open(dir, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestSegment writes a sealed segment starting at firstIndex containing entries.
+func writeTestSegment(t *testing.T, dir string, firstIndex Index, entries [][]byte) {
+	t.Helper()
+	seg, err := newSegment(dir, &Config{}, firstIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		write(t, seg, e, firstIndex+Index(i))
+	}
+	if err := seg.finish(); err != nil {
+		t.Fatal(err)
+	}
+	seg.reader.close()
+}
+
+func Test_LogSegmentGap(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := testEntries(35)
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, entries)
+	if err := os.Remove(path.Join(dir, "00000000000000000011-00000000000000000020.seg")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Open(dir, &Config{}, false)
+	var nc *NonContiguousError
+	if !errors.Is(err, ErrNonContiguousSegments) || !errors.As(err, &nc) {
+		t.Fatalf("Expecting ErrNonContiguousSegments, got %v", err)
+	}
+	exp := []SegmentGap{{
+		Prev: "00000000000000000001-00000000000000000010.seg", PrevLast: 10,
+		Next: "00000000000000000021-00000000000000000030.seg", NextFirst: 21,
+	}}
+	if !reflect.DeepEqual(nc.Gaps, exp) {
+		t.Errorf("Unexpected gaps %+v", nc.Gaps)
+	}
+	if _, err := Open(dir, &Config{SegmentCheck: SegmentCheckLenient, ReadOnly: true}, false); !errors.Is(err, ErrNonContiguousSegments) {
+		t.Errorf("Read only log can't be repaired, expecting ErrNonContiguousSegments, got %v", err)
+	}
+
+	var repairs []SegmentRepair
+	cfg := Config{SegmentCheck: SegmentCheckLenient, OnSegmentRepair: func(r SegmentRepair) {
+		repairs = append(repairs, r)
+	}}
+	log, err := Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if len(repairs) != 1 || !repairs[0].Removed || repairs[0].From != 1 || repairs[0].To != 10 {
+		t.Errorf("Unexpected repairs %+v", repairs)
+	}
+	checkRange(t, log, 21, 35, entries)
+}
+
+func Test_LogSegmentOverlap(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := testEntries(25)
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, entries)
+	// as if RewindTo(15) removed 21-25, and appended 15 & 16, but the truncation of 11-20 was lost.
+	if err := os.Remove(path.Join(dir, "00000000000000000021-00000000000000000025.seg")); err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries[:14], []byte("fifteen"), []byte("sixteen"))
+	writeTestSegment(t, dir, 15, entries[14:])
+
+	_, err := Open(dir, &Config{}, false)
+	if !errors.Is(err, ErrNonContiguousSegments) {
+		t.Fatalf("Expecting ErrNonContiguousSegments, got %v", err)
+	}
+	var repairs []SegmentRepair
+	cfg := Config{SegmentCheck: SegmentCheckLenient, OnSegmentRepair: func(r SegmentRepair) {
+		repairs = append(repairs, r)
+	}}
+	log, err := Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || repairs[0].Removed || repairs[0].From != 15 || repairs[0].To != 20 {
+		t.Errorf("Unexpected repairs %+v", repairs)
+	}
+	checkRange(t, log, 1, 16, entries)
+	log.Close()
+
+	// the repair is persisted
+	log, err = Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkRange(t, log, 1, 16, entries)
+}
+
+func Test_LogRewindCrash(t *testing.T) {
+	const seg1 = "00000000000000000001-00000000000000000010.seg"
+	// crash states of RewindTo(6) after it removed 11-20 & the sidecar of 1-10.
+	crashes := map[string]struct {
+		name     string // the filename segment 1-10 is left with
+		truncate bool
+		strict   bool // true if a strict Open should succeed
+	}{
+		"renamed":           {"00000000000000000001.seg", false, true},
+		"renamedTruncated":  {"00000000000000000001.seg", true, true},
+		"truncatedNotNamed": {seg1, true, false}, // truncated without being renamed first
+	}
+	for name, c := range crashes {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			entries := testEntries(20)
+			writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, entries)
+			log, err := Open(dir, &Config{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := log.items[0].loadOffsets(); err != nil {
+				t.Fatal(err)
+			}
+			offset := log.items[0].offsets[5]
+			log.Close()
+			for _, fn := range []string{"00000000000000000011-00000000000000000020.seg", "00000000000000000011-00000000000000000020.idx", indexFilename(seg1)} {
+				if err := os.Remove(path.Join(dir, fn)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Rename(path.Join(dir, seg1), path.Join(dir, c.name)); err != nil {
+				t.Fatal(err)
+			}
+			last := Index(10)
+			if c.truncate {
+				if err := os.Truncate(path.Join(dir, c.name), offset); err != nil {
+					t.Fatal(err)
+				}
+				last = 5
+			}
+
+			log, err = Open(dir, &Config{}, false)
+			if !c.strict {
+				if !errors.Is(err, ErrNonContiguousSegments) {
+					t.Fatalf("Expecting ErrNonContiguousSegments, got %v", err)
+				}
+				var repairs []SegmentRepair
+				cfg := Config{SegmentCheck: SegmentCheckLenient, OnSegmentRepair: func(r SegmentRepair) {
+					repairs = append(repairs, r)
+				}}
+				log, err = Open(dir, &cfg, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(repairs) != 1 || repairs[0].Removed || repairs[0].From != 6 || repairs[0].To != 10 {
+					t.Errorf("Unexpected repairs %+v", repairs)
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			checkRange(t, log, 1, last, entries)
+			if idx, err := log.Append([]byte("next")); err != nil || idx != last+1 {
+				t.Errorf("Append returned %d %v, expecting %d", idx, err, last+1)
+			}
+		})
+	}
+}
+
+func checkRange(t *testing.T, log *Log, first, last Index, entries [][]byte) {
+	t.Helper()
+	if log.FirstIndex() != first || log.LastIndex() != last {
+		t.Fatalf("Unexpected log range %d-%d, expecting %d-%d", log.FirstIndex(), log.LastIndex(), first, last)
+	}
+	iterate(t, log, first, last, entries)
+}
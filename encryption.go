@@ -0,0 +1,163 @@
+package raftylog
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptionAlgorithm identifies the AEAD used to encrypt entries. Like the checksum,
+// the algorithm & key id are recorded in each segment's header, so segments written
+// with an older algorithm or key continue to be readable.
+//
+// Each segment has its own key, derived from the KeyProvider's key and a random salt
+// stored in the segment's header. Each entry is sealed with a nonce made from its index,
+// which is unique within a segment as an index is never written to the same segment twice,
+// a segment that's rewound or that fails a write is finished and new entries go to a new
+// segment.
+type EncryptionAlgorithm uint8
+
+const (
+	// EncryptionNone stores entries unencrypted.
+	EncryptionNone EncryptionAlgorithm = iota
+	// EncryptionAESGCM is AES-256 in GCM mode.
+	EncryptionAESGCM
+	// EncryptionChaCha20Poly1305 is ChaCha20-Poly1305, fast on hardware without AES instructions.
+	EncryptionChaCha20Poly1305
+)
+
+func (a EncryptionAlgorithm) String() string {
+	switch a {
+	case EncryptionNone:
+		return "None"
+	case EncryptionAESGCM:
+		return "AES-GCM"
+	case EncryptionChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("EncryptionAlgorithm(%d)", uint8(a))
+}
+
+// KeyProvider supplies the keys used to encrypt segments. Keys should be at least 16
+// random bytes, and are identified by an id of at most 255 bytes that's stored
+// unencrypted in each segment's header.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new segments with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the supplied id, used to read existing segments.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys. To rotate keys, add a new key
+// and make it Current, older keys should be kept until all the segments using them have
+// been deleted.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	if key, exists := k.Keys[id]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Key %q not found", id)
+}
+
+const (
+	// segmentSaltLen is the size of the random salt used to derive a segment's key.
+	segmentSaltLen = 16
+	// minKeyLen is the smallest key accepted from a KeyProvider.
+	minKeyLen = 16
+)
+
+// newSalt returns a random salt for a new segment.
+func newSalt() ([segmentSaltLen]byte, error) {
+	var salt [segmentSaltLen]byte
+	_, err := rand.Read(salt[:])
+	return salt, err
+}
+
+// segmentCipher returns the AEAD for a segment, its key is derived from key & the segment's salt.
+func segmentCipher(a EncryptionAlgorithm, key []byte, salt [segmentSaltLen]byte) (cipher.AEAD, error) {
+	if len(key) < minKeyLen {
+		return nil, fmt.Errorf("Encryption keys must be at least %d bytes", minKeyLen)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("raftylog segment key"))
+	mac.Write(salt[:])
+	segmentKey := mac.Sum(nil)
+	switch a {
+	case EncryptionAESGCM:
+		block, err := aes.NewCipher(segmentKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case EncryptionChaCha20Poly1305:
+		return chacha20poly1305.New(segmentKey)
+	}
+	return nil, fmt.Errorf("Unsupported encryption algorithm %v", a)
+}
+
+// segmentCipherFor returns the AEAD used for the entries of a segment with header h, or
+// nil if the segment isn't encrypted.
+func segmentCipherFor(h *segmentHeader, keys KeyProvider) (cipher.AEAD, error) {
+	if h.encryption == EncryptionNone {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, errors.New("Segment is encrypted, but there's no KeyProvider configured")
+	}
+	key, err := keys.Key(h.keyID)
+	if err != nil {
+		return nil, err
+	}
+	return segmentCipher(h.encryption, key, h.salt)
+}
+
+// entryNonce returns the nonce for the entry at idx.
+func entryNonce(aead cipher.AEAD, idx Index) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, uint64(idx))
+	return nonce
+}
+
+// decrypt authenticates and decrypts the stored data of the entry at idx.
+func (s *segmentReader) decrypt(idx Index, data []byte) ([]byte, error) {
+	if s.aead == nil {
+		return nil, errors.New("segment isn't encrypted")
+	}
+	return s.aead.Open(nil, entryNonce(s.aead, idx), data, nil)
+}
+
+// newSegmentEncryption sets up the encryption of a new segment with header h using the
+// current key, and returns the segment's AEAD.
+func newSegmentEncryption(h *segmentHeader, config *Config) (cipher.AEAD, error) {
+	if config.Keys == nil {
+		return nil, errors.New("Encryption requires a KeyProvider")
+	}
+	id, key, err := config.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.setEncryption(config.Encryption, id, salt); err != nil {
+		return nil, err
+	}
+	return segmentCipher(config.Encryption, key, salt)
+}
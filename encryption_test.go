@@ -0,0 +1,212 @@
+package raftylog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testKeys(current string, ids ...string) *StaticKeys {
+	keys := &StaticKeys{Current: current, Keys: make(map[string][]byte)}
+	for _, id := range ids {
+		keys.Keys[id] = bytes.Repeat([]byte(id), 32)[:32]
+	}
+	return keys
+}
+
+func Test_SegmentHeaderEncryption(t *testing.T) {
+	h := newSegmentHeader(5, ChecksumCRC32C, CompressionNone)
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.setEncryption(EncryptionAESGCM, "key-1", salt); err != nil {
+		t.Fatal(err)
+	}
+	b := h.marshal()
+	if int64(len(b)) != h.size {
+		t.Errorf("Header size %d doesn't match marshaled length %d", h.size, len(b))
+	}
+	act, err := readSegmentHeader(bytes.NewReader(b), "test.seg", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.encryption != EncryptionAESGCM || act.keyID != "key-1" || act.salt != salt || act.size != h.size {
+		t.Errorf("Header didn't round trip\n%+v\n%+v", h, act)
+	}
+	if err := h.setEncryption(EncryptionAESGCM, strings.Repeat("k", 256), salt); err == nil {
+		t.Errorf("A key id longer than 255 bytes should fail")
+	}
+}
+
+func Test_LogEncryption(t *testing.T) {
+	for _, alg := range []EncryptionAlgorithm{EncryptionAESGCM, EncryptionChaCha20Poly1305} {
+		for _, compression := range []CompressionAlgorithm{CompressionNone, CompressionS2} {
+			t.Run(fmt.Sprintf("%v_%v", alg, compression), func(t *testing.T) {
+				dir, cleanup := testDir(t)
+				defer cleanup()
+				cfg := Config{MaxSegmentItems: 10, Encryption: alg, Keys: testKeys("a", "a"), Compression: compression, Mmap: true}
+				log, err := Open(dir, &cfg, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries := testEntries(25)
+				if _, _, err := log.AppendBatch(entries); err != nil {
+					t.Fatal(err)
+				}
+				checkEntries(t, log, entries)
+				if err := log.Close(); err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadFile(path.Join(dir, "00000000000000000001-00000000000000000010.seg"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(data, []byte("entry 1 entry 1")) {
+					t.Errorf("Segment contains unencrypted data")
+				}
+
+				log, err = Open(dir, &cfg, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkEntries(t, log, entries)
+				log.Close()
+
+				if _, err := Open(dir, &Config{}, false); err == nil || !strings.Contains(err.Error(), "no KeyProvider") {
+					t.Errorf("Expecting error opening encrypted log without keys, got %v", err)
+				}
+				wrongKey := testKeys("a", "b")
+				wrongKey.Keys["a"] = wrongKey.Keys["b"]
+				log, err = Open(dir, &Config{Keys: wrongKey}, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer log.Close()
+				if _, err := log.Read(3); err == nil || !strings.Contains(err.Error(), "couldn't be decrypted") {
+					t.Errorf("Expecting decryption error with wrong key, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func Test_LogEncryptionKeyRotation(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{MaxSegmentItems: 10, Encryption: EncryptionAESGCM, Keys: testKeys("a", "a")}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(30)
+	if _, _, err := log.AppendBatch(entries[:5]); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	cfg.Keys = testKeys("b", "a", "b")
+	log, err = Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := log.AppendBatch(entries[5:]); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, log, entries)
+	if id := log.items[0].header.keyID; id != "a" {
+		t.Errorf("Unexpected key id %q for first segment", id)
+	}
+	if id := log.items[len(log.items)-1].header.keyID; id != "b" {
+		t.Errorf("Unexpected key id %q for last segment", id)
+	}
+	log.Close()
+
+	// the old key is needed until its segments are deleted
+	if _, err := Open(dir, &Config{Keys: testKeys("b", "b")}, false); err == nil || !strings.Contains(err.Error(), `Key "a" not found`) {
+		t.Errorf("Expecting error about missing key, got %v", err)
+	}
+}
+
+func Test_LogEncryptionRewind(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{MaxSegmentItems: 5, Encryption: EncryptionChaCha20Poly1305, Keys: testKeys("a", "a")}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(9)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	// rewinding the writer finishes it, so that new entries go in a new segment
+	if err := log.RewindTo(8); err != nil {
+		t.Fatal(err)
+	}
+	if log.writer != nil || len(log.items) != 2 || log.items[1].filename != "00000000000000000006-00000000000000000007.seg" {
+		t.Errorf("Unexpected segments after rewind %v", log.items)
+	}
+	entries = append(entries[:7], []byte("eight"), []byte("nine"))
+	if _, _, err := log.AppendBatch(entries[7:]); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, log, entries)
+	if len(log.items) != 3 || log.items[2].firstIndex != 8 {
+		t.Errorf("Unexpected segments after append %v", log.items)
+	}
+
+	// an empty writer is removed
+	if err := log.RewindTo(8); err != nil {
+		t.Fatal(err)
+	}
+	if log.writer != nil || len(log.items) != 2 || log.LastIndex() != 7 {
+		t.Errorf("Unexpected segments after rewind %v", log.items)
+	}
+	if _, err := log.Append([]byte("eight")); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, log, entries[:8])
+}
+
+func Test_LogEncryptionFailedWrite(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{MaxSegmentItems: 5, Encryption: EncryptionAESGCM, Keys: testKeys("a", "a")}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(4)
+	if _, _, err := log.AppendBatch(entries[:2]); err != nil {
+		t.Fatal(err)
+	}
+	// make the next write fail
+	w := log.writer
+	f, err := os.Open(path.Join(dir, w.reader.filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.reader.f.Close()
+	w.reader.f = f
+	if _, err := log.Append(entries[2]); err == nil {
+		t.Fatal("Expecting append to a read only file to fail")
+	}
+	// the retry has to go to a new segment, so that index 3 isn't sealed twice with the same nonce
+	if log.writer != nil || len(log.items) != 1 || log.items[0].filename != "00000000000000000001-00000000000000000002.seg" {
+		t.Errorf("Unexpected segments after failed write %v", log.items)
+	}
+	if _, _, err := log.AppendBatch(entries[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if log.writer.reader.header.salt == w.reader.header.salt {
+		t.Errorf("New segment should have a new salt")
+	}
+	checkEntries(t, log, entries)
+}
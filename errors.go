@@ -0,0 +1,47 @@
+package raftylog
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrIndexBeforeFirst is returned when reading or rewinding to an index that's before
+	// the first index in the log, e.g. because it's been removed by DeleteTo.
+	ErrIndexBeforeFirst = errors.New("Index is before the first index in the log")
+	// ErrIndexAfterLast is returned when reading an index that hasn't been written yet,
+	// or when DeleteTo or RewindTo are passed an index past the end of the log.
+	ErrIndexAfterLast = errors.New("Index is after the last index in the log")
+	// ErrCorruptEntry is returned when an entry fails validation when its read, the
+	// error is a *CorruptEntryError with the details.
+	ErrCorruptEntry = errors.New("Entry is corrupt")
+	// ErrNonContiguousSegments is returned by Open when the segments in the log directory
+	// don't form a contiguous range of indexes.
+	ErrNonContiguousSegments = errors.New("Log segments aren't contiguous")
+	// ErrLogClosed is returned when using a log that's been closed.
+	ErrLogClosed = errors.New("Log is closed")
+	// ErrLocked is returned by Open when the log directory is already open, either by
+	// another process or by an earlier Open in this process.
+	ErrLocked = errors.New("Log directory is locked by another user")
+)
+
+// CorruptEntryError describes an entry that failed validation. errors.Is reports it as
+// ErrCorruptEntry.
+type CorruptEntryError struct {
+	Segment string // filename of the segment containing the entry
+	Offset  int64  // offset of the entry in the segment, or of its block for block compressed segments
+	Index   Index
+	Err     error // what's wrong with the entry
+}
+
+func (e *CorruptEntryError) Error() string {
+	return fmt.Sprintf("Entry at index %d with offset %d in segment %v is corrupt: %v", e.Index, e.Offset, e.Segment, e.Err)
+}
+
+func (e *CorruptEntryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptEntryError) Is(target error) bool {
+	return target == ErrCorruptEntry
+}
@@ -0,0 +1,101 @@
+package raftylog
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func Test_LogErrors(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(25)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.DeleteTo(11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, &Config{}, false); !errors.Is(err, ErrLocked) || !errors.Is(err, ErrLogLocked) {
+		t.Errorf("Expecting ErrLocked, got %v", err)
+	}
+	tests := []struct {
+		name string
+		err  error
+		exp  error
+	}{
+		{"Read before first", func() error { _, err := log.Read(3); return err }(), ErrIndexBeforeFirst},
+		{"Read after last", func() error { _, err := log.Read(26); return err }(), ErrIndexAfterLast},
+		{"DeleteTo entire log", log.DeleteTo(25), ErrIndexAfterLast},
+		{"RewindTo before first", log.RewindTo(5), ErrIndexBeforeFirst},
+		{"RewindTo after last", log.RewindTo(27), ErrIndexAfterLast},
+	}
+	for _, tc := range tests {
+		if !errors.Is(tc.err, tc.exp) {
+			t.Errorf("%s: expecting %v, got %v", tc.name, tc.exp, tc.err)
+		}
+	}
+
+	// corrupt the last byte of the hash of entry 12
+	seg := log.items[0]
+	if err := seg.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	offset := seg.offsets[1]
+	f, err := os.OpenFile(seg.f.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff}, seg.offsets[2]-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.Read(12)
+	var corrupt *CorruptEntryError
+	if !errors.Is(err, ErrCorruptEntry) || !errors.As(err, &corrupt) {
+		t.Fatalf("Expecting corrupt entry error, got %v", err)
+	}
+	if corrupt.Index != 12 || corrupt.Offset != offset || path.Base(corrupt.Segment) != "00000000000000000011-00000000000000000020.seg" {
+		t.Errorf("Unexpected corrupt entry error %+v", corrupt)
+	}
+
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.Read(15); err != ErrLogClosed {
+		t.Errorf("Expecting ErrLogClosed from Read, got %v", err)
+	}
+	if _, err := log.Append([]byte("more")); err != ErrLogClosed {
+		t.Errorf("Expecting ErrLogClosed from Append, got %v", err)
+	}
+	if err := log.RewindTo(15); err != ErrLogClosed {
+		t.Errorf("Expecting ErrLogClosed from RewindTo, got %v", err)
+	}
+}
+
+func Test_RaftLogGetLogNotFound(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLog(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if err := log.StoreLog(&raft.Log{Index: 1, Term: 1, Data: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	var l raft.Log
+	for _, idx := range []uint64{0, 2} {
+		if err := log.GetLog(idx, &l); err != raft.ErrLogNotFound {
+			t.Errorf("GetLog(%d) should return ErrLogNotFound, got %v", idx, err)
+		}
+	}
+}
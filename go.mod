@@ -2,4 +2,9 @@ module github.com/superfell/raftylog
 
 go 1.16
 
-require github.com/hashicorp/raft v1.3.3 // indirect
+require (
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/hashicorp/raft v1.3.3
+	github.com/klauspost/compress v1.13.6
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+)
@@ -0,0 +1,143 @@
+package raftylog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// iteratorBufferSize is the size of the buffer used to read through segment files.
+const iteratorBufferSize = 64 * 1024
+
+// Iterator reads a range of entries from a Log in index order, or in reverse order for a
+// ReverseIterator. Its much faster than calling Read for each entry, as it reads through
+// each segment sequentially. An Iterator isn't safe for concurrent use, but the log can be
+// used & changed while its being iterated. If an entry is removed by DeleteTo or RewindTo
+// before its reached, Next returns false and Err reports that its not available.
+//
+//	it := log.Iterator(log.FirstIndex(), log.LastIndex())
+//	for it.Next() {
+//		apply(it.Index(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	log     *Log
+	next    Index // index of the next entry to read
+	to      Index
+	reverse bool
+	index   Index
+	value   []byte
+	err     error
+
+	seg     *segmentReader
+	changes uint64        // log.changes when seg was found
+	r       *bufio.Reader // reads seg's file sequentially from pos, up to limit
+	pos     int64
+	limit   int64
+}
+
+// Iterator returns an Iterator over the entries from..to inclusive.
+func (log *Log) Iterator(from, to Index) *Iterator {
+	return &Iterator{log: log, next: from, to: to}
+}
+
+// ReverseIterator returns an Iterator over the entries from..to inclusive in reverse
+// order, from should be greater than or equal to to.
+func (log *Log) ReverseIterator(from, to Index) *Iterator {
+	return &Iterator{log: log, next: from, to: to, reverse: true}
+}
+
+// Next advances to the next entry, returning false when there are no more entries or
+// an error occurred.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.done() {
+		return false
+	}
+	log := it.log
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	if it.seg == nil || it.changes != log.changes || it.next > it.seg.lastIndex || it.next < it.seg.firstIndex {
+		seg, err := log.segmentFor(it.next)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.seg = seg
+		it.changes = log.changes
+		it.r = nil
+	}
+	value, err := it.read()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.index = it.next
+	it.value = value
+	if it.reverse {
+		it.next--
+	} else {
+		it.next++
+	}
+	return true
+}
+
+// done returns true once the iterator has moved past to.
+func (it *Iterator) done() bool {
+	if it.reverse {
+		return it.next < it.to || it.next == 0
+	}
+	return it.next > it.to
+}
+
+// read returns the entry at it.next from it.seg, the caller should hold the log's read lock.
+func (it *Iterator) read() ([]byte, error) {
+	s := it.seg
+	if s.mm != nil || s.blocks != nil || it.reverse {
+		// mapped & block compressed segments don't need a seek for each entry, and reverse
+		// iteration can't use a sequential reader.
+		return s.readShared(it.next, false)
+	}
+	if it.r == nil || it.pos >= it.limit {
+		if err := s.loadOffsets(); err != nil {
+			return nil, err
+		}
+		it.pos = s.offsets[it.next-s.firstIndex]
+		it.limit = math.MaxInt64
+		if w := it.log.writer; w != nil && s == &w.reader {
+			// don't read past what's been published, as there may be a write in progress.
+			it.limit = w.fileSize
+		}
+		it.r = bufio.NewReaderSize(io.NewSectionReader(s.f, it.pos, it.limit-it.pos), iteratorBufferSize)
+	}
+	var scratch [4]byte
+	if _, err := io.ReadFull(it.r, scratch[:]); err != nil {
+		return nil, err
+	}
+	vlen := binary.LittleEndian.Uint32(scratch[:])
+	body := make([]byte, frameSize(s.header.version, int(vlen))-4)
+	if _, err := io.ReadFull(it.r, body); err != nil {
+		return nil, err
+	}
+	offset := it.pos
+	it.pos += int64(len(body)) + 4
+	data, _, err := s.decodeFrame(it.next, offset, body)
+	return data, err
+}
+
+// Index returns the index of the current entry.
+func (it *Iterator) Index() Index {
+	return it.index
+}
+
+// Value returns the data of the current entry, it remains valid after Next is called.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
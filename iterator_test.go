@@ -0,0 +1,228 @@
+package raftylog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func iterate(t *testing.T, log *Log, from, to Index, entries [][]byte) {
+	t.Helper()
+	it := log.Iterator(from, to)
+	next := from
+	for it.Next() {
+		if it.Index() != next {
+			t.Fatalf("Unexpected index %d, expecting %d", it.Index(), next)
+		}
+		if !bytes.Equal(it.Value(), entries[next-1]) {
+			t.Errorf("Unexpected value for index %d", next)
+		}
+		next++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if to >= from && next != to+1 {
+		t.Errorf("Iteration stopped at %d, expecting %d", next, to+1)
+	}
+}
+
+func Test_LogIterator(t *testing.T) {
+	configs := map[string]Config{
+		"plain":       {MaxSegmentItems: 10},
+		"mmap":        {MaxSegmentItems: 10, Mmap: true},
+		"compression": {MaxSegmentItems: 10, Compression: CompressionS2},
+		"blocks":      {MaxSegmentItems: 10, SegmentCompression: CompressionZstd, SegmentBlockSize: 512},
+		"encryption":  {MaxSegmentItems: 10, Encryption: EncryptionAESGCM, Keys: testKeys("a", "a")},
+	}
+	for name, cfg := range configs {
+		cfg := cfg
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			log, err := Open(dir, &cfg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			entries := testEntries(55)
+			if _, _, err := log.AppendBatch(entries); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SegmentCompression != CompressionNone {
+				waitFor(t, func() bool { return compressedSegments(log) == 5 })
+			}
+			iterate(t, log, 1, 55, entries)
+			iterate(t, log, 7, 23, entries)
+			iterate(t, log, 50, 50, entries)
+			iterate(t, log, 10, 9, entries)
+
+			it := log.Iterator(54, 56)
+			for it.Next() {
+			}
+			if it.Index() != 55 || it.Err() == nil || !strings.Contains(it.Err().Error(), "not available") {
+				t.Errorf("Iterating past the end should fail after the last entry, got %d %v", it.Index(), it.Err())
+			}
+		})
+	}
+}
+
+func Test_LogIteratorConcurrentChanges(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(100)
+	if _, _, err := log.AppendBatch(entries[:5]); err != nil {
+		t.Fatal(err)
+	}
+	// entries appended during the iteration, including in the writer segment, are read
+	it := log.Iterator(1, 100)
+	for i := 5; i < 100; i++ {
+		if !it.Next() {
+			t.Fatalf("Iteration stopped at %d: %v", i-4, it.Err())
+		}
+		if _, err := log.Append(entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for it.Next() {
+	}
+	if it.Err() != nil || it.Index() != 100 {
+		t.Errorf("Unexpected end of iteration %d %v", it.Index(), it.Err())
+	}
+	for i := Index(1); i <= 100; i++ {
+		if it := log.Iterator(i, i); !it.Next() || !bytes.Equal(it.Value(), entries[i-1]) {
+			t.Errorf("Unexpected value for %d", i)
+		}
+	}
+
+	// entries removed before they're reached stop the iteration
+	it = log.Iterator(1, 100)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	if err := log.DeleteTo(21); err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() || it.Err() == nil || !strings.Contains(it.Err().Error(), "not available") {
+		t.Errorf("Expecting iteration to fail after DeleteTo, got %v", it.Err())
+	}
+	it = log.Iterator(21, 100)
+	for it.Next() && it.Index() < 50 {
+	}
+	if err := log.RewindTo(60); err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries[:59], []byte("new"))
+	if _, err := log.Append(entries[59]); err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+		if !bytes.Equal(it.Value(), entries[it.Index()-1]) {
+			t.Errorf("Unexpected value for %d after rewind", it.Index())
+		}
+	}
+	if it.Index() != 60 || it.Err() == nil {
+		t.Errorf("Unexpected end of iteration after rewind %d %v", it.Index(), it.Err())
+	}
+}
+
+func benchmarkReplay(b *testing.B, fn func(log *Log, last Index) error) {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := Open(dir, &Config{MaxSegmentItems: 10000, Sync: SyncNever}, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer log.Close()
+	entries := make([][]byte, 1000)
+	for i := range entries {
+		entries[i] = []byte(fmt.Sprintf("entry %d", i))
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, err := log.AppendBatch(entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fn(log, log.LastIndex()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_ReplayRead(b *testing.B) {
+	benchmarkReplay(b, func(log *Log, last Index) error {
+		for i := Index(1); i <= last; i++ {
+			if _, err := log.Read(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func Benchmark_ReplayIterator(b *testing.B) {
+	benchmarkReplay(b, func(log *Log, last Index) error {
+		it := log.Iterator(1, last)
+		for it.Next() {
+		}
+		return it.Err()
+	})
+}
+
+func Test_LogReverseIterator(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(35)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	reverse := func(from, to Index) {
+		t.Helper()
+		it := log.ReverseIterator(from, to)
+		next := from
+		for it.Next() {
+			if it.Index() != next || !bytes.Equal(it.Value(), entries[next-1]) {
+				t.Fatalf("Unexpected entry %d, expecting %d", it.Index(), next)
+			}
+			next--
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if from >= to && next != to-1 {
+			t.Errorf("Iteration stopped at %d, expecting %d", next, to-1)
+		}
+	}
+	reverse(35, 1)
+	reverse(23, 7)
+	reverse(11, 11)
+	reverse(5, 6)
+
+	if err := log.DeleteTo(11); err != nil {
+		t.Fatal(err)
+	}
+	it := log.ReverseIterator(12, 1)
+	for it.Next() {
+	}
+	if it.Index() != 11 || it.Err() == nil || !strings.Contains(it.Err().Error(), "not available") {
+		t.Errorf("Iterating before the start should fail after the first entry, got %d %v", it.Index(), it.Err())
+	}
+}
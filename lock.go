@@ -0,0 +1,43 @@
+package raftylog
+
+import (
+	"errors"
+	"os"
+	"path"
+)
+
+// lockFilename is the name of the file in the log directory used to stop the
+// log being opened more than once at a time.
+const lockFilename = "LOCK"
+
+var (
+	// ErrLogLocked is the original name of ErrLocked.
+	//
+	// Deprecated: use ErrLocked.
+	ErrLogLocked = ErrLocked
+	// ErrReadOnly is returned when trying to change a log opened with Config.ReadOnly set.
+	ErrReadOnly = errors.New("Log was opened read only")
+)
+
+// lockDir takes the lock on the log directory, exclusive for writers and shared
+// for read only users.
+func lockDir(dir string, readOnly bool) (*os.File, error) {
+	fn := path.Join(dir, lockFilename)
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil && readOnly {
+		f, err = os.Open(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := flockFile(f, !readOnly); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockDir(f *os.File) error {
+	err := funlockFile(f)
+	return any(err, f.Close())
+}
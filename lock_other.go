@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package raftylog
+
+import (
+	"os"
+)
+
+// flockFile isn't supported on this platform, the log directory isn't protected
+// from being opened more than once.
+func flockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func funlockFile(f *os.File) error {
+	return nil
+}
@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Index uint64
@@ -13,92 +16,465 @@ type Index uint64
 type Config struct {
 	MaxSegmentFileSize int64
 	MaxSegmentItems    int64
+
+	// Sync controls when appended entries are fsync'd, see SyncPolicy.
+	Sync SyncPolicy
+	// SyncEntries & SyncInterval are the thresholds used by SyncPeriodic.
+	SyncEntries  int
+	SyncInterval time.Duration
+
+	// Checksum is the algorithm used to hash entries in new segments.
+	Checksum ChecksumAlgorithm
+
+	// Compression is the algorithm used to compress new entries. Entries smaller than
+	// CompressionMinSize, or that don't get any smaller, are stored uncompressed.
+	Compression        CompressionAlgorithm
+	CompressionMinSize int
+
+	// SegmentCompression if set recompresses sealed segments in the background into a block
+	// compressed format, apart from the most recent UncompressedSegments sealed segments.
+	// SegmentBlockSize is the uncompressed size of each block, 64KiB if not set.
+	SegmentCompression   CompressionAlgorithm
+	SegmentBlockSize     int
+	UncompressedSegments int
+
+	// OnSegmentCompressionError if set is called when a segment couldn't be compressed in
+	// the background, the segment is left uncompressed.
+	OnSegmentCompressionError func(segment string, err error)
+
+	// Encryption if set encrypts new entries with a key from Keys, which is also used to
+	// read existing encrypted segments.
+	Encryption EncryptionAlgorithm
+	Keys       KeyProvider
+
+	// ReadOnly opens the log without taking an exclusive lock on it. Any attempt to
+	// change a read only log fails with ErrReadOnly.
+	ReadOnly bool
+
+	// Mmap memory maps sealed segments and reads entries directly from the mapping.
+	Mmap bool
+
+	// OnTailRepair if set is called by Open for each unfinished segment that had
+	// a torn or corrupt tail truncated from it, or that was removed because its header
+	// was incomplete.
+	OnTailRepair func(TailRepair)
+
+	// SegmentCheck controls what Open does if the log's segments aren't contiguous. With
+	// SegmentCheckLenient, OnSegmentRepair if set is called for each segment that's changed.
+	SegmentCheck    SegmentCheckMode
+	OnSegmentRepair func(SegmentRepair)
+
+	// entryKey if set extracts a key from an entry's data, see searchKeys.
+	entryKey func([]byte) (uint64, error)
+	// quarantineDir if set is where segments discarded by SegmentCheckLenient are moved
+	// to rather than being deleted, see Repair.
+	quarantineDir string
+	// skipDecryption if set opens encrypted segments without their keys, their entries'
+	// hashes can be checked but the entries can't be read. Used by Repair.
+	skipDecryption bool
 }
 
+// validate checks that the algorithms used for new segments are supported.
+func (c *Config) validate() error {
+	if _, err := checksumFor(c.Checksum); err != nil {
+		return err
+	}
+	if _, err := compressorFor(c.Compression); err != nil {
+		return err
+	}
+	if _, err := compressorFor(c.SegmentCompression); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Log is safe for concurrent use. Any number of readers can run alongside a single
+// appender, appends & other changes to the log are serialized.
 type Log struct {
 	config Config
 	dir    string
-	items  []*segmentReader
-	writer *segmentReaderWriter
+
+	// appendLock serializes appenders and other changes to the log. lock protects items
+	// and the segment state seen by readers. Entries are written to the segment file while
+	// only holding appendLock, and then published to readers while holding lock.
+	appendLock sync.Mutex
+	lock       sync.RWMutex
+	lockFile   *os.File // holds the flock on the log directory
+	items      []*segmentReader
+	writer     *segmentReaderWriter
+	sync       syncState
+	changes    uint64 // incremented when segments are removed, replaced or reopened, protected by lock
+	closed     bool
+	notify     chan struct{}              // closed when the log next changes, see waitChannel
+	subs       map[*subscription]struct{} // active subscribers, see Subscribe
+
+	// the background segment compressor, see compressSegments.
+	compressWake chan struct{}
+	compressStop chan struct{}
+	compressDone chan struct{}
+	stopOnce     sync.Once
 }
 
+// Open opens the log stored in dir. The directory is locked while the log is open,
+// if its already open Open returns ErrLocked. Logs opened with Config.ReadOnly take
+// a shared lock, so any number of read only users can open a log at the same time.
 func Open(dir string, config *Config, createIfMissing bool) (*Log, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	if len(files) == 0 && !createIfMissing {
+	if !containsSegments(files) && (!createIfMissing || config.ReadOnly) {
 		return nil, errors.New("Directory doesn't contain a log")
 	}
+	lockFile, err := lockDir(dir, config.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	// now we have the lock, re-read the directory in case it changed.
+	if files, err = os.ReadDir(dir); err != nil {
+		unlockDir(lockFile)
+		return nil, err
+	}
 	log := Log{
-		config: *config,
-		dir:    dir,
-		items:  make([]*segmentReader, 0, len(files)),
+		config:   *config,
+		dir:      dir,
+		lockFile: lockFile,
+		items:    make([]*segmentReader, 0, len(files)),
+	}
+	if err := log.openSegments(files); err != nil {
+		log.closeSegments()
+		unlockDir(lockFile)
+		return nil, err
+	}
+	log.startCompressor()
+	return &log, nil
+}
+
+func containsSegments(files []os.DirEntry) bool {
+	for _, f := range files {
+		if !f.IsDir() && isSegmentFile(f.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSegmentFile returns true if filename is a segment, either regular or block compressed.
+func isSegmentFile(filename string) bool {
+	return strings.HasSuffix(filename, ".seg") || strings.HasSuffix(filename, ".segz")
+}
+
+// openSegments opens all the segment files in files and adds them to log.items.
+func (log *Log) openSegments(files []os.DirEntry) error {
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[f.Name()] = true
 	}
 	for _, f := range files {
 		if f.IsDir() {
 			continue // error?
 		}
-		if !strings.HasSuffix(f.Name(), ".seg") {
+		if strings.HasSuffix(f.Name(), ".segz.tmp") && !log.config.ReadOnly {
+			// left over from a crash while compressing a segment.
+			if err := os.Remove(path.Join(log.dir, f.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isSegmentFile(f.Name()) {
+			continue
+		}
+		if names[f.Name()+"z"] {
+			// a crash after compressing a segment but before removing the original, the
+			// compressed copy is complete so the original can go.
+			if !log.config.ReadOnly {
+				os.Remove(path.Join(log.dir, indexFilename(f.Name())))
+				if err := os.Remove(path.Join(log.dir, f.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		seg, err := openSegment(log.dir, f.Name(), &log.config)
+		if errors.Is(err, errIncompleteHeader) && !strings.Contains(f.Name(), "-") {
+			// a crash while creating the segment, before its header was written.
+			if err := log.removeTornSegment(f, err); err != nil {
+				return err
+			}
 			continue
 		}
-		seg, err := openSegment(dir, f.Name())
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if seg.repair != nil && log.config.OnTailRepair != nil {
+			log.config.OnTailRepair(*seg.repair)
+		}
+		if seg.lastIndex < seg.firstIndex {
+			// an unfinished segment without any complete entries, the next
+			// writer would reuse its filename, so remove it.
+			if log.config.ReadOnly {
+				seg.close()
+				continue
+			}
+			if err := seg.delete(); err != nil {
+				return err
+			}
+			continue
 		}
 		log.items = append(log.items, seg)
 	}
 	sort.Slice(log.items, func(a, b int) bool {
+		if log.items[a].firstIndex == log.items[b].firstIndex {
+			return log.items[a].lastIndex < log.items[b].lastIndex
+		}
 		return log.items[a].firstIndex < log.items[b].firstIndex
 	})
-	// TODO assert log segments are contiguous
-	return &log, nil
+	if err := log.checkLastSealed(); err != nil {
+		return err
+	}
+	return log.checkContiguous()
+}
+
+// removeTornSegment removes an unfinished segment whose header is incomplete, reporting it
+// to OnTailRepair. A read only log ignores the segment instead.
+func (log *Log) removeTornSegment(f os.DirEntry, reason error) error {
+	if log.config.ReadOnly {
+		return nil
+	}
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path.Join(log.dir, f.Name())); err != nil {
+		return err
+	}
+	if log.config.OnTailRepair != nil {
+		first, _, _ := parseSegmentFilename(f.Name())
+		log.config.OnTailRepair(TailRepair{
+			Segment:   f.Name(),
+			LastIndex: first - 1,
+			Discarded: info.Size(),
+			Reason:    reason.Error(),
+		})
+	}
+	return nil
 }
 
+// Append writes a new entry to the end of the log, returning its index. The entry
+// is fsync'd before returning according to the configured SyncPolicy.
 func (log *Log) Append(data []byte) (Index, error) {
+	idx, _, err := log.AppendBatch([][]byte{data})
+	return idx, err
+}
+
+// AppendBatch writes entries to the end of the log, returning the index of the first
+// and last entry written. Each segment's share of the entries is written with a single
+// write, and the batch is fsync'd once according to the configured SyncPolicy.
+func (log *Log) AppendBatch(entries [][]byte) (first, last Index, err error) {
+	if len(entries) == 0 {
+		return 0, 0, errors.New("No entries to append")
+	}
+	if log.config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	if log.closed {
+		return 0, 0, ErrLogClosed
+	}
+	if first, last, err = log.appendBatch(entries); err != nil {
+		return first, last, err
+	}
+	return first, last, log.commit(len(entries))
+}
+
+// Sync fsyncs any appended entries that have not yet been flushed to disk.
+func (log *Log) Sync() error {
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	return log.syncWriter()
+}
+
+// syncWriter fsyncs the writer segment if there are unsynced entries, the caller should hold appendLock.
+func (log *Log) syncWriter() error {
+	if err := log.sync.err; err != nil {
+		log.sync.err = nil
+		return err
+	}
+	if log.writer == nil || log.sync.unsynced == 0 {
+		return nil
+	}
+	log.sync.reset()
+	return log.writer.sync()
+}
+
+// commit applies the sync policy after n entries have been appended.
+func (log *Log) commit(n int) error {
+	if log.sync.due(&log.config, n) {
+		return log.syncWriter()
+	}
+	log.syncLater()
+	return nil
+}
+
+// syncLater starts the sync timer if there are unsynced entries that SyncPeriodic needs
+// to sync once SyncInterval has passed. The caller should hold appendLock.
+func (log *Log) syncLater() {
+	d, ok := log.sync.wait(&log.config)
+	if !ok || log.sync.pending {
+		return
+	}
+	log.sync.pending = true
+	if log.sync.timer == nil {
+		log.sync.timer = time.AfterFunc(d, log.syncTimer)
+	} else {
+		log.sync.timer.Reset(d)
+	}
+}
+
+// syncTimer is run by the sync timer, it syncs the writer if the unsynced entries are
+// older than SyncInterval, otherwise it restarts the timer for the newer entries.
+func (log *Log) syncTimer() {
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	log.sync.pending = false
+	if log.closed {
+		return
+	}
+	if d, ok := log.sync.wait(&log.config); ok && d <= 0 {
+		if err := log.syncWriter(); err != nil {
+			log.sync.err = err
+		}
+	}
+	log.syncLater()
+}
+
+// appendBatch appends entries without syncing them, rolling over to new segments as needed.
+// The caller should hold appendLock.
+func (log *Log) appendBatch(entries [][]byte) (first, last Index, err error) {
+	for len(entries) > 0 {
+		if err = log.ensureWriter(); err != nil {
+			return first, last, err
+		}
+		start := log.writer.nextIndex
+		offsets, fileSize, err := log.writer.writeBatch(entries)
+		if err != nil {
+			if log.writer.reader.aead != nil {
+				// retrying the write in this segment would reuse the nonces of entries
+				// that may have reached the disk, so the retry goes to a new segment.
+				return first, last, any(err, log.abandonWriter())
+			}
+			return first, last, err
+		}
+		log.lock.Lock()
+		log.writer.publish(offsets, fileSize)
+		log.broadcast()
+		log.lock.Unlock()
+		if first == 0 {
+			first = start
+		}
+		last = log.writer.nextIndex - 1
+		entries = entries[len(offsets):]
+	}
+	return first, last, nil
+}
+
+// ensureWriter makes sure there's a writer segment with space for at least one more entry.
+// The caller should hold appendLock.
+func (log *Log) ensureWriter() error {
+	if log.writer != nil && !log.writer.full() {
+		return nil
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
 	nextIndex := Index(1)
 	var err error
-	if log.writer != nil && log.writer.full() {
+	if log.writer != nil {
+		// finish syncs the segment so any pending entries are now durable.
 		if err = log.writer.finish(); err != nil {
-			return 0, err
+			return err
 		}
+		log.sync.reset()
+		log.changes++
 		nextIndex = log.writer.nextIndex
 		log.writer = nil
+		log.wakeCompressor()
 	}
-	if log.writer == nil {
-		if nextIndex == 1 && len(log.items) > 0 {
-			nextIndex = log.items[len(log.items)-1].lastIndex + 1
-		}
-		log.writer, err = newSegment(log.dir, &log.config, nextIndex)
-		if err != nil {
-			return 0, err
-		}
-		log.items = append(log.items, &log.writer.reader)
+	if nextIndex == 1 && len(log.items) > 0 {
+		nextIndex = log.items[len(log.items)-1].lastIndex + 1
+	}
+	log.writer, err = newSegment(log.dir, &log.config, nextIndex)
+	if err != nil {
+		return err
 	}
-	return log.writer.append(data)
+	log.items = append(log.items, &log.writer.reader)
+	return nil
 }
 
 func (log *Log) Read(idx Index) ([]byte, error) {
-	if idx < log.FirstIndex() {
-		return nil, fmt.Errorf("Index %d not available, earliest available index is %d", idx, log.FirstIndex())
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	seg, err := log.segmentFor(idx)
+	if err != nil {
+		return nil, err
+	}
+	return seg.read(idx)
+}
+
+// segmentFor returns the segment containing idx, the caller should hold lock.
+func (log *Log) segmentFor(idx Index) (*segmentReader, error) {
+	if log.closed {
+		return nil, ErrLogClosed
+	}
+	if idx < log.firstIndex() {
+		return nil, fmt.Errorf("%w, index %d not available, earliest available index is %d", ErrIndexBeforeFirst, idx, log.firstIndex())
 	}
-	if idx > log.LastIndex() {
-		return nil, fmt.Errorf("Index %d not available, lastest available index is %d", idx, log.LastIndex())
+	if idx > log.lastIndex() {
+		return nil, fmt.Errorf("%w, index %d not available, latest available index is %d", ErrIndexAfterLast, idx, log.lastIndex())
 	}
 	segIdx := sort.Search(len(log.items), func(i int) bool {
 		return log.items[i].lastIndex >= idx
 	})
 	if segIdx < len(log.items) && idx <= log.items[segIdx].lastIndex {
-		return log.items[segIdx].read(idx)
+		return log.items[segIdx], nil
 	}
-	return nil, fmt.Errorf("Index %d is after any available index", idx)
+	return nil, fmt.Errorf("%w, index %d is after any available index", ErrIndexAfterLast, idx)
+}
+
+// ReadShared is like Read, but for memory mapped segments (see Config.Mmap) it returns
+// a slice of the mapping rather than a copy. The returned data must not be modified, and
+// is only valid until the entry is removed by DeleteTo or RewindTo, its segment is
+// compressed in the background, or the log is closed.
+func (log *Log) ReadShared(idx Index) ([]byte, error) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	seg, err := log.segmentFor(idx)
+	if err != nil {
+		return nil, err
+	}
+	return seg.readShared(idx, true)
 }
 
 // Delete all log entries with an index < idx
 func (log *Log) DeleteTo(idx Index) error {
-	if idx >= log.LastIndex() {
-		return errors.New("Can't delete entire log")
+	if log.config.ReadOnly {
+		return ErrReadOnly
+	}
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if log.closed {
+		return ErrLogClosed
 	}
+	if idx >= log.lastIndex() {
+		return fmt.Errorf("%w, can't delete entire log", ErrIndexAfterLast)
+	}
+	log.changes++
+	defer log.broadcast()
 	for len(log.items) > 0 && log.items[0].lastIndex < idx {
 		err := log.items[0].delete()
 		log.items = log.items[1:]
@@ -106,21 +482,52 @@ func (log *Log) DeleteTo(idx Index) error {
 			return err
 		}
 	}
-	return nil
+	return log.syncDir()
+}
+
+// syncDir fsyncs the log directory, unless the sync policy is SyncNever.
+func (log *Log) syncDir() error {
+	if log.config.Sync == SyncNever {
+		return nil
+	}
+	return syncDir(log.dir)
 }
 
 // RewindTo truncates the end of the log making idx the next index to be written.
 // You can't Rewind to before the current logs FirstIndex.
 func (log *Log) RewindTo(idx Index) error {
-	if idx <= log.FirstIndex() {
-		return errors.New("Can't rewind that far back")
+	if log.config.ReadOnly {
+		return ErrReadOnly
+	}
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if log.closed {
+		return ErrLogClosed
+	}
+	if idx <= log.firstIndex() {
+		return fmt.Errorf("%w, can't rewind that far back", ErrIndexBeforeFirst)
 	}
-	if idx > log.LastIndex() {
-		return errors.New("Can't rewind past the end of the log")
+	if idx > log.lastIndex() {
+		return fmt.Errorf("%w, can't rewind past the end of the log", ErrIndexAfterLast)
 	}
+	log.changes++
+	defer log.rewound(idx)
 	// easy case, we want to rewind to a spot that's inside the current writer
 	if log.writer != nil && idx >= log.writer.reader.firstIndex {
-		return log.writer.rewindTo(idx)
+		if err := log.writer.rewindTo(idx); err != nil {
+			return err
+		}
+		log.sync.reset()
+		if log.writer.reader.aead != nil {
+			// reusing the segment would reuse the nonces of the removed entries.
+			return log.retireWriter()
+		}
+		if log.config.Sync == SyncNever {
+			return nil
+		}
+		return log.writer.sync()
 	}
 	// harder case, we want to rewind to a spot that in a previous segment
 	log.writer = nil
@@ -133,30 +540,115 @@ func (log *Log) RewindTo(idx Index) error {
 			return err
 		}
 	}
+	log.sync.reset()
 	// now we need to split the segment on the idx boundary.
-	if idx == log.LastIndex()+1 {
+	if idx == log.lastIndex()+1 {
 		// we may of ended exactly on an existing segment boundary. if so we're done
-		return nil
+		return log.syncDir()
 	}
-	return log.items[len(log.items)-1].rewindTo(idx)
+	last, err := log.truncateSegment(log.items[len(log.items)-1], idx)
+	log.items[len(log.items)-1] = last
+	if err != nil {
+		return err
+	}
+	return log.syncDir()
 	// the next write will deal with creating a new writer, we don't need to do it here
 }
 
+// truncateSegment removes the entries from idx on from seg. A block compressed segment
+// is replaced with an uncompressed copy, the returned segment should replace seg in items
+// even if there's an error.
+func (log *Log) truncateSegment(seg *segmentReader, idx Index) (*segmentReader, error) {
+	if seg.blocks != nil {
+		// block compressed segments can't be truncated, so switch back to an uncompressed copy.
+		fn, err := seg.decompressSegment()
+		if err != nil {
+			return seg, err
+		}
+		plain, err := openSegment(log.dir, fn, &log.config)
+		if err != nil {
+			return seg, err
+		}
+		if err := seg.delete(); err != nil {
+			plain.close()
+			return seg, err
+		}
+		seg = plain
+	}
+	if err := seg.rewindTo(idx); err != nil {
+		return seg, err
+	}
+	if log.config.Sync != SyncNever {
+		return seg, seg.f.Sync()
+	}
+	return seg, nil
+}
+
+// retireWriter stops any more entries being written to the current writer segment, the
+// next append starts a new segment. The caller should hold appendLock & lock.
+func (log *Log) retireWriter() error {
+	w := log.writer
+	log.writer = nil
+	if w.nextIndex > w.reader.firstIndex {
+		return w.finish()
+	}
+	log.items = log.items[:len(log.items)-1]
+	return any(w.reader.delete(), log.syncDir())
+}
+
+// abandonWriter retires the writer after a failed write, removing anything the write left
+// after the last published entry. The caller should hold appendLock.
+func (log *Log) abandonWriter() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	log.changes++
+	log.sync.reset()
+	err := log.writer.reader.f.Truncate(log.writer.fileSize)
+	return any(log.retireWriter(), err)
+}
+
+// Close closes the log and releases the lock on the log directory.
 func (log *Log) Close() error {
+	log.stopCompressor()
+	log.appendLock.Lock()
+	defer log.appendLock.Unlock()
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	log.changes++
+	log.closed = true
+	log.broadcast()
+	if log.sync.timer != nil {
+		log.sync.timer.Stop()
+	}
 	if log.writer != nil {
 		if err := log.writer.finish(); err != nil {
 			return err
 		}
 	}
+	log.closeSegments()
+	if log.lockFile == nil {
+		return nil
+	}
+	err := unlockDir(log.lockFile)
+	log.lockFile = nil
+	return err
+}
+
+func (log *Log) closeSegments() {
 	for _, item := range log.items {
 		item.close()
 	}
 	log.items = nil
 	log.writer = nil
-	return nil
 }
 
 func (log *Log) FirstIndex() Index {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	return log.firstIndex()
+}
+
+func (log *Log) firstIndex() Index {
 	if len(log.items) == 0 {
 		return 0
 	}
@@ -164,8 +656,55 @@ func (log *Log) FirstIndex() Index {
 }
 
 func (log *Log) LastIndex() Index {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	return log.lastIndex()
+}
+
+func (log *Log) lastIndex() Index {
 	if len(log.items) == 0 {
 		return 0
 	}
 	return log.items[len(log.items)-1].lastIndex
 }
+
+// SegmentInfo describes one of the log's segment files, see Segments.
+type SegmentInfo struct {
+	Filename   string
+	FirstIndex Index
+	LastIndex  Index // FirstIndex-1 if the segment is empty
+	Size       int64
+	Sealed     bool // true once the segment is full, no more entries will be written to it
+	Compressed bool // true if the segment has been block compressed, see Config.SegmentCompression
+	Encrypted  bool
+}
+
+// Segments returns details of the log's segments, in index order.
+func (log *Log) Segments() ([]SegmentInfo, error) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	if log.closed {
+		return nil, ErrLogClosed
+	}
+	segs := make([]SegmentInfo, len(log.items))
+	for i, s := range log.items {
+		segs[i] = SegmentInfo{
+			Filename:   s.filename,
+			FirstIndex: s.firstIndex,
+			LastIndex:  s.lastIndex,
+			Sealed:     s.sealed(),
+			Compressed: s.blocks != nil,
+			Encrypted:  s.header.encryption != EncryptionNone,
+		}
+		if w := log.writer; w != nil && s == &w.reader {
+			segs[i].Size = w.fileSize
+			continue
+		}
+		info, err := s.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		segs[i].Size = info.Size()
+	}
+	return segs, nil
+}
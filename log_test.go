@@ -2,8 +2,13 @@ package raftylog
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -47,6 +52,7 @@ func Test_Log(t *testing.T) {
 		t.Errorf("Expected 7 segments but have %d", len(log.items))
 	}
 	// open when the writer didn't clean up
+	crash(t, log)
 	log2, err := Open(dir, &Config{MaxSegmentItems: 3}, true)
 	if err != nil {
 		t.Fatal(err)
@@ -60,6 +66,7 @@ func Test_Log(t *testing.T) {
 			t.Errorf("Unexpected data %v returned for index %d", d, indexes[i])
 		}
 	}
+	log2.Close()
 	log.Close()
 	// open when the writer did cleanup
 	log3, err := Open(dir, &Config{MaxSegmentItems: 3}, true)
@@ -120,3 +127,432 @@ func Test_Log(t *testing.T) {
 	}
 	t.Log(log3.items)
 }
+
+// crash releases the lock on the log's directory without closing the log, as if
+// the process had crashed, so that the directory can be opened again.
+func crash(t *testing.T, log *Log) {
+	if err := unlockDir(log.lockFile); err != nil {
+		t.Fatal(err)
+	}
+	log.lockFile = nil
+}
+
+func Test_LogLocked(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.Append([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		if _, err := Open(dir, &Config{}, true); err != ErrLogLocked {
+			t.Errorf("Second Open of log should fail with ErrLogLocked, but got %v", err)
+		}
+		if _, err := Open(dir, &Config{ReadOnly: true}, false); err != ErrLogLocked {
+			t.Errorf("Read only Open of a log open for writing should fail with ErrLogLocked, but got %v", err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro1, err := Open(dir, &Config{ReadOnly: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro1.Close()
+	ro2, err := Open(dir, &Config{ReadOnly: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := ro2.Read(1); err != nil || !bytes.Equal(d, []byte{1}) {
+		t.Errorf("Unexpected result from read only log %v %v", d, err)
+	}
+	if _, err := ro2.Append([]byte{2}); err != ErrReadOnly {
+		t.Errorf("Append to read only log should fail with ErrReadOnly, but got %v", err)
+	}
+	if err := ro2.RewindTo(1); err != ErrReadOnly {
+		t.Errorf("RewindTo on read only log should fail with ErrReadOnly, but got %v", err)
+	}
+	if runtime.GOOS == "linux" {
+		if _, err := Open(dir, &Config{}, false); err != ErrLogLocked {
+			t.Errorf("Open for writing while read only users have it open should fail with ErrLogLocked, but got %v", err)
+		}
+	}
+	ro1.Close()
+	ro2.Close()
+	log, err = Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	if _, err := Open(t.TempDir(), &Config{ReadOnly: true}, true); err == nil {
+		t.Errorf("Read only open of an empty directory should fail")
+	}
+}
+
+func Test_LogAppendBatch(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 3}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := func(start, count byte) [][]byte {
+		entries := make([][]byte, count)
+		for i := range entries {
+			entries[i] = []byte{start + byte(i)}
+		}
+		return entries
+	}
+	if _, _, err := log.AppendBatch(nil); err == nil {
+		t.Errorf("AppendBatch with no entries should fail")
+	}
+	first, last, err := log.AppendBatch(batch(0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || last != 10 {
+		t.Errorf("AppendBatch returned unexpected range %d-%d", first, last)
+	}
+	if len(log.items) != 4 {
+		t.Errorf("Expected batch to be split over 4 segments, but have %d", len(log.items))
+	}
+	first, last, err = log.AppendBatch(batch(10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 11 || last != 12 {
+		t.Errorf("AppendBatch returned unexpected range %d-%d", first, last)
+	}
+	check := func(log *Log) {
+		for i := Index(1); i <= 12; i++ {
+			d, err := log.Read(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, []byte{byte(i - 1)}) {
+				t.Errorf("Unexpected data %v returned for index %d", d, i)
+			}
+		}
+	}
+	check(log)
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log, err = Open(dir, &Config{MaxSegmentItems: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	check(log)
+}
+
+func benchmarkAppend(b *testing.B, batchSize int, fn func(log *Log, entries [][]byte) error) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := Open(dir, &Config{MaxSegmentFileSize: 64 * 1024 * 1024, Sync: SyncNever}, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer log.Close()
+	entries := make([][]byte, batchSize)
+	for i := range entries {
+		entries[i] = make([]byte, 100)
+	}
+	b.SetBytes(int64(batchSize * 100))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fn(log, entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_Append64(b *testing.B) {
+	benchmarkAppend(b, 64, func(log *Log, entries [][]byte) error {
+		for _, e := range entries {
+			if _, err := log.Append(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func Benchmark_AppendBatch64(b *testing.B) {
+	benchmarkAppend(b, 64, func(log *Log, entries [][]byte) error {
+		_, _, err := log.AppendBatch(entries)
+		return err
+	})
+}
+
+func Test_LogOpenRepairsTornTail(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	var repairs []TailRepair
+	cfg := Config{MaxSegmentItems: 4, OnTailRepair: func(r TailRepair) {
+		repairs = append(repairs, r)
+	}}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 6; i++ {
+		if _, err := log.Append([]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// simulate a crash part way through writing entry 7
+	if _, err := log.writer.reader.f.WriteAt([]byte{1, 0, 0, 0, 6}, log.writer.fileSize); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, log)
+	log2, err := Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || repairs[0].LastIndex != 6 || repairs[0].Discarded != 5 {
+		t.Errorf("Unexpected repairs reported %+v", repairs)
+	}
+	if log2.LastIndex() != 6 {
+		t.Errorf("Unexpected LastIndex %d", log2.LastIndex())
+	}
+	idx, err := log2.Append([]byte{6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 7 {
+		t.Errorf("Append after repair returned index %d, expecting 7", idx)
+	}
+
+	// a crash before the first entry in a new segment is complete leaves a segment with no entries.
+	if _, err := log2.Append([]byte{7}); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := newSegment(dir, &cfg, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.reader.f.WriteAt([]byte{1, 0}, empty.fileSize); err != nil {
+		t.Fatal(err)
+	}
+	seg := empty.reader.filename
+	crash(t, log2)
+	repairs = nil
+	log3, err := Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log3.Close()
+	if len(repairs) != 1 || repairs[0].Segment != seg {
+		t.Errorf("Unexpected repairs reported %+v", repairs)
+	}
+	if _, err := os.Stat(path.Join(dir, seg)); !os.IsNotExist(err) {
+		t.Errorf("Empty segment %s should of been removed, %v", seg, err)
+	}
+	if log3.LastIndex() != 8 {
+		t.Errorf("Unexpected LastIndex %d", log3.LastIndex())
+	}
+	for i := Index(1); i <= 8; i++ {
+		d, err := log3.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d, []byte{byte(i - 1)}) {
+			t.Errorf("Unexpected data %v for index %d", d, i)
+		}
+	}
+}
+
+func Test_LogOpenRemovesTornHeader(t *testing.T) {
+	headers := map[string]int{"empty": 0, "partialMagic": 5, "partialHeader": 9}
+	for name, size := range headers {
+		size := size
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			writeTestLog(t, dir, &Config{MaxSegmentItems: 4}, testEntries(8))
+			// a crash while creating the next segment, before its header was written.
+			seg, err := newSegment(dir, &Config{}, 9)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := seg.reader.f.Truncate(int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			seg.reader.close()
+			var repairs []TailRepair
+			cfg := Config{MaxSegmentItems: 4, OnTailRepair: func(r TailRepair) {
+				repairs = append(repairs, r)
+			}}
+			log, err := Open(dir, &cfg, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			if len(repairs) != 1 || repairs[0].Segment != seg.reader.filename || repairs[0].Discarded != int64(size) {
+				t.Errorf("Unexpected repairs reported %+v", repairs)
+			}
+			if _, err := os.Stat(path.Join(dir, seg.reader.filename)); !os.IsNotExist(err) {
+				t.Errorf("Torn segment should of been removed, %v", err)
+			}
+			if idx, err := log.Append([]byte{8}); err != nil || idx != 9 {
+				t.Errorf("Append after repair returned %d %v, expecting 9", idx, err)
+			}
+		})
+	}
+}
+
+func Test_LogMmap(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{MaxSegmentItems: 3, Mmap: true}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 10; i++ {
+		if _, err := log.Append([]byte{i, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log, err = Open(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if runtime.GOOS == "linux" {
+		for _, seg := range log.items[:3] {
+			if seg.mm == nil {
+				t.Errorf("Sealed segment %v should be memory mapped", seg)
+			}
+		}
+	}
+	check := func(last Index) {
+		for i := log.FirstIndex(); i <= last; i++ {
+			exp := []byte{byte(i - 1), byte(i - 1)}
+			d, err := log.ReadShared(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, exp) {
+				t.Errorf("Unexpected data %v from ReadShared for index %d", d, i)
+			}
+			d, err = log.Read(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, exp) {
+				t.Errorf("Unexpected data %v from Read for index %d", d, i)
+			}
+		}
+	}
+	check(10)
+	// rewind into the middle of a mapped segment
+	if err := log.RewindTo(5); err != nil {
+		t.Fatal(err)
+	}
+	check(4)
+	if _, err := log.ReadShared(5); err == nil {
+		t.Errorf("Read of rewound index should fail")
+	}
+	if err := log.DeleteTo(3); err != nil {
+		t.Fatal(err)
+	}
+	check(4)
+}
+
+func Test_LogConcurrentReaders(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%t", mmap), func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			log, err := Open(dir, &Config{MaxSegmentItems: 16, Sync: SyncNever, Mmap: mmap}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			entry := func(i Index) []byte {
+				return []byte(fmt.Sprintf("entry-%d", i))
+			}
+			const count = 2000
+			done := make(chan struct{})
+			errs := make(chan error, 16)
+			wg := sync.WaitGroup{}
+			for r := 0; r < 8; r++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(seed))
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						last := log.LastIndex()
+						if last == 0 {
+							continue
+						}
+						idx := Index(rnd.Int63n(int64(last))) + 1
+						d, err := log.Read(idx)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !bytes.Equal(d, entry(idx)) {
+							errs <- fmt.Errorf("Unexpected data %s for index %d", d, idx)
+							return
+						}
+					}
+				}(int64(r))
+			}
+			for i := Index(1); i <= count; i++ {
+				if _, err := log.Append(entry(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(done)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func Test_LogSegments(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if _, _, err := log.AppendBatch(testEntries(15)); err != nil {
+		t.Fatal(err)
+	}
+	segs, err := log.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 2 {
+		t.Fatalf("Unexpected segments %+v", segs)
+	}
+	if s := segs[0]; s.Filename != "00000000000000000001-00000000000000000010.seg" || s.FirstIndex != 1 || s.LastIndex != 10 || !s.Sealed || s.Size == 0 {
+		t.Errorf("Unexpected sealed segment %+v", s)
+	}
+	if s := segs[1]; s.FirstIndex != 11 || s.LastIndex != 15 || s.Sealed || s.Size != log.writer.fileSize {
+		t.Errorf("Unexpected writer segment %+v", s)
+	}
+}
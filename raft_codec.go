@@ -0,0 +1,230 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raft.Log entries are stored using a fixed binary encoding
+//	tag          byte     binaryLogTagV1
+//	index        uvarint
+//	term         uvarint
+//	type         byte     raft.LogType
+//	appendedAt   varint   nanoseconds since the unix epoch, 0 for the zero time
+//	data         uvarint length followed by the data
+//	extensions   uvarint length followed by the extensions
+//
+// Entries written by older versions are gob encoded. A gob stream starts with its
+// message length, encoded either as a single byte < 0x80 or a byte count >= 0xF8, so
+// the tag byte can never be the first byte of a gob encoded entry.
+
+const binaryLogTagV1 = 0xB1
+
+// Codec converts raft.Log entries to & from the bytes stored in the log.
+type Codec interface {
+	// ID identifies the codec's format. Its recorded in the log directory so that opening
+	// the log with a different codec fails instead of decoding garbage.
+	ID() string
+	Encode(*raft.Log) ([]byte, error)
+	Decode([]byte, *raft.Log) error
+}
+
+// BinaryCodec is the default Codec, using the binary encoding described above. It can
+// also decode gob encoded entries written by older versions.
+type BinaryCodec struct{}
+
+func (BinaryCodec) ID() string {
+	return "raftylog-binary"
+}
+
+func (BinaryCodec) Encode(l *raft.Log) ([]byte, error) {
+	return appendRaftLog(nil, l), nil
+}
+
+func (BinaryCodec) Decode(data []byte, l *raft.Log) error {
+	return decodeRaftLog(data, l)
+}
+
+var errShortRaftLog = errors.New("Encoded raft log entry is truncated")
+
+// appendRaftLog appends the binary encoding of l to buf.
+func appendRaftLog(buf []byte, l *raft.Log) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	buf = append(buf, binaryLogTagV1)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], l.Index)]...)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], l.Term)]...)
+	buf = append(buf, byte(l.Type))
+	appendedAt := int64(0)
+	if !l.AppendedAt.IsZero() {
+		appendedAt = l.AppendedAt.UnixNano()
+	}
+	buf = append(buf, scratch[:binary.PutVarint(scratch[:], appendedAt)]...)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(len(l.Data)))]...)
+	buf = append(buf, l.Data...)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(len(l.Extensions)))]...)
+	return append(buf, l.Extensions...)
+}
+
+// decodeRaftLog decodes an entry written by appendRaftLog, or a gob encoded entry written
+// by an older version, into l. l's Data & Extensions may point into data.
+func decodeRaftLog(data []byte, l *raft.Log) error {
+	if len(data) == 0 {
+		return errShortRaftLog
+	}
+	if data[0] != binaryLogTagV1 {
+		*l = raft.Log{}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(l)
+	}
+	d := raftLogDecoder{data: data[1:]}
+	index := d.uvarint()
+	term := d.uvarint()
+	typ := d.byte()
+	appendedAt := d.varint()
+	entry := d.bytes()
+	ext := d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("Encoded raft log entry has %d unexpected trailing bytes", len(d.data))
+	}
+	*l = raft.Log{
+		Index:      index,
+		Term:       term,
+		Type:       raft.LogType(typ),
+		Data:       entry,
+		Extensions: ext,
+	}
+	if appendedAt != 0 {
+		l.AppendedAt = time.Unix(0, appendedAt)
+	}
+	return nil
+}
+
+// raftLogTerm returns a function that extracts the term from entries encoded by codec.
+func raftLogTerm(codec Codec) func([]byte) (uint64, error) {
+	if _, ok := codec.(BinaryCodec); ok {
+		return decodeRaftLogTerm
+	}
+	return func(data []byte) (uint64, error) {
+		var l raft.Log
+		err := codec.Decode(data, &l)
+		return l.Term, err
+	}
+}
+
+// decodeRaftLogTerm returns the term of an encoded entry without decoding the rest of it.
+func decodeRaftLogTerm(data []byte) (uint64, error) {
+	if len(data) == 0 || data[0] != binaryLogTagV1 {
+		var l raft.Log
+		err := decodeRaftLog(data, &l)
+		return l.Term, err
+	}
+	d := raftLogDecoder{data: data[1:]}
+	d.uvarint()
+	term := d.uvarint()
+	return term, d.err
+}
+
+// raftLogDecoder reads fields from an encoded entry, once a read fails err is set and
+// subsequent reads return zero values.
+type raftLogDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *raftLogDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errShortRaftLog
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *raftLogDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errShortRaftLog
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *raftLogDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.err = errShortRaftLog
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *raftLogDecoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.data)) {
+		d.err = errShortRaftLog
+		return nil
+	}
+	if l == 0 {
+		return nil
+	}
+	b := d.data[:l:l]
+	d.data = d.data[l:]
+	return b
+}
+
+// codecFilename is the file in the log directory that records the id of the Codec used by the log.
+const codecFilename = "CODEC"
+
+// ErrCodecMismatch is returned by OpenLogWithCodec when the log was written using a different Codec.
+var ErrCodecMismatch = errors.New("Log was written with a different codec")
+
+// checkCodec verifies that codec matches the one recorded in the log's directory, recording
+// it if this is the first time the log has been opened with a codec. Logs written before the
+// codec was recorded used the built in encoding.
+func checkCodec(log *Log, codec Codec) error {
+	fn := path.Join(log.dir, codecFilename)
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != codec.ID() {
+			return fmt.Errorf("%w: log uses %q but was opened with %q", ErrCodecMismatch, id, codec.ID())
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if log.LastIndex() > 0 && codec.ID() != (BinaryCodec{}).ID() {
+		return fmt.Errorf("%w: log uses %q but was opened with %q", ErrCodecMismatch, BinaryCodec{}.ID(), codec.ID())
+	}
+	if log.config.ReadOnly {
+		return nil
+	}
+	return writeFileAtomic(fn, []byte(codec.ID()+"\n"))
+}
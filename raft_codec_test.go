@@ -0,0 +1,235 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func testRaftLogs() []raft.Log {
+	return []raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogConfiguration, Data: []byte{1, 2, 3}},
+		{Index: 1 << 40, Term: 300, Type: raft.LogCommand, Data: bytes.Repeat([]byte{'x'}, 1000), Extensions: []byte{4}, AppendedAt: time.Now()},
+		{Index: 5, Term: 2, Type: raft.LogNoop},
+	}
+}
+
+func Test_RaftCodecRoundTrip(t *testing.T) {
+	for _, l := range testRaftLogs() {
+		enc := appendRaftLog(nil, &l)
+		// decode into an entry with existing values to make sure they're all replaced
+		act := raft.Log{Index: 99, Extensions: []byte{9}, Data: []byte{9}, AppendedAt: time.Now()}
+		if err := decodeRaftLog(enc, &act); err != nil {
+			t.Fatal(err)
+		}
+		if !logEq(l, act) || !l.AppendedAt.Equal(act.AppendedAt) {
+			t.Errorf("Entry didn't round trip\n%+v\n%+v", l, act)
+		}
+		for i := 0; i < len(enc); i++ {
+			if err := decodeRaftLog(enc[:i], &act); err == nil {
+				t.Errorf("Decoding truncated entry of length %d should fail", i)
+			}
+		}
+	}
+}
+
+func Test_RaftCodecDecodesGob(t *testing.T) {
+	for _, l := range testRaftLogs() {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&l); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Bytes()[0] == binaryLogTagV1 {
+			t.Fatalf("gob encoding starts with the binary tag")
+		}
+		act := raft.Log{}
+		if err := decodeRaftLog(buf.Bytes(), &act); err != nil {
+			t.Fatal(err)
+		}
+		if !logEq(l, act) {
+			t.Errorf("gob entry didn't decode\n%+v\n%+v", l, act)
+		}
+	}
+}
+
+func Test_RaftLogReadsGobEntries(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	// write some entries the way older versions did
+	log, err := Open(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := testRaftLogs()[:1]
+	for i := range logs {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&logs[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := log.Append(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := OpenLog(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	e2 := raft.Log{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("new")}
+	if err := rl.StoreLog(&e2); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []raft.Log{logs[0], e2} {
+		act := raft.Log{}
+		if err := rl.GetLog(exp.Index, &act); err != nil {
+			t.Fatal(err)
+		}
+		if !logEq(exp, act) {
+			t.Errorf("Entries don't match\n%+v\n%+v", exp, act)
+		}
+	}
+}
+
+func benchmarkEntry() *raft.Log {
+	return &raft.Log{Index: 123456, Term: 7, Type: raft.LogCommand, Data: bytes.Repeat([]byte{'d'}, 64), AppendedAt: time.Now()}
+}
+
+func Benchmark_RaftCodecGobEncode(b *testing.B) {
+	l := benchmarkEntry()
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := gob.NewEncoder(&buf).Encode(l); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(buf.Len()), "bytes/entry")
+}
+
+func Benchmark_RaftCodecBinaryEncode(b *testing.B) {
+	l := benchmarkEntry()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = appendRaftLog(buf[:0], l)
+	}
+	b.ReportMetric(float64(len(buf)), "bytes/entry")
+}
+
+func Benchmark_RaftCodecGobDecode(b *testing.B) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(benchmarkEntry()); err != nil {
+		b.Fatal(err)
+	}
+	l := raft.Log{}
+	for i := 0; i < b.N; i++ {
+		if err := decodeRaftLog(buf.Bytes(), &l); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_RaftCodecBinaryDecode(b *testing.B) {
+	enc := appendRaftLog(nil, benchmarkEntry())
+	l := raft.Log{}
+	for i := 0; i < b.N; i++ {
+		if err := decodeRaftLog(enc, &l); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// jsonCodec is a custom codec used to test OpenLogWithCodec.
+type jsonCodec struct{}
+
+func (jsonCodec) ID() string {
+	return "test-json"
+}
+
+func (jsonCodec) Encode(l *raft.Log) ([]byte, error) {
+	return json.Marshal(l)
+}
+
+func (jsonCodec) Decode(data []byte, l *raft.Log) error {
+	*l = raft.Log{}
+	return json.Unmarshal(data, l)
+}
+
+func Test_RaftLogCustomCodec(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLogWithCodec(dir, &Config{}, true, jsonCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := testRaftLogs()
+	logs[1].Index = 2
+	logs[2].Index = 3
+	for i := range logs {
+		if err := log.StoreLog(&logs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLog(dir, &Config{}, false); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("Opening log with the wrong codec should fail with ErrCodecMismatch, but got %v", err)
+	}
+	log, err = OpenLogWithCodec(dir, &Config{}, false, jsonCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for _, exp := range logs {
+		act := raft.Log{}
+		if err := log.GetLog(exp.Index, &act); err != nil {
+			t.Fatal(err)
+		}
+		if !logEq(exp, act) {
+			t.Errorf("Entries don't match\n%+v\n%+v", exp, act)
+		}
+	}
+	raw, err := log.log.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[0] != '{' {
+		t.Errorf("Entry should of been encoded as json, but was %q", raw)
+	}
+}
+
+func Test_RaftLogCodecForExistingLog(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	// a log written before the codec was recorded uses the built in codec
+	log, err := Open(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.Append(appendRaftLog(nil, &raft.Log{Index: 1})); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	if _, err := OpenLogWithCodec(dir, &Config{}, false, jsonCodec{}); !errors.Is(err, ErrCodecMismatch) {
+		t.Errorf("Opening existing log with a custom codec should fail with ErrCodecMismatch, but got %v", err)
+	}
+	rl, err := OpenLog(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+	data, err := ioutil.ReadFile(path.Join(dir, codecFilename))
+	if err != nil || string(data) != (BinaryCodec{}).ID()+"\n" {
+		t.Errorf("Unexpected codec file contents %q %v", data, err)
+	}
+}
@@ -1,87 +1,242 @@
 package raftylog
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
 
 	"github.com/hashicorp/raft"
 )
 
+// maxCommitGroup is the most StoreLogs requests that'll be written together in one group commit.
+const maxCommitGroup = 256
+
 type RaftLog struct {
-	log  *Log
-	buf  bytes.Buffer
-	lock sync.Mutex
+	log   *Log
+	codec Codec
+	// lock serializes writes to the log, reads don't need it as Log is safe for concurrent use.
+	lock   sync.Mutex
+	groups int // number of group commits written, protected by lock
+
+	commits   chan *commitRequest
+	closing   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// commitRequest is a StoreLogs call waiting on the group commit writer.
+type commitRequest struct {
+	logs []*raft.Log
+	err  chan error
 }
 
+// OpenLog opens the raft log in dir using the default BinaryCodec.
 func OpenLog(dir string, cfg *Config, createIfNeeded bool) (*RaftLog, error) {
-	l, err := Open(dir, cfg, createIfNeeded)
+	return OpenLogWithCodec(dir, cfg, createIfNeeded, BinaryCodec{})
+}
+
+// OpenLogWithCodec opens the raft log in dir, using codec to encode & decode entries.
+// If the log was written using a different codec it fails with ErrCodecMismatch.
+func OpenLogWithCodec(dir string, cfg *Config, createIfNeeded bool, codec Codec) (*RaftLog, error) {
+	c := *cfg
+	c.entryKey = raftLogTerm(codec) // used by FindFirstIndexOfTerm & FindLastIndexOfTerm
+	l, err := Open(dir, &c, createIfNeeded)
 	if err != nil {
 		return nil, err
 	}
-	log := RaftLog{log: l}
+	if err := checkCodec(l, codec); err != nil {
+		l.Close()
+		return nil, err
+	}
+	log := RaftLog{
+		log:     l,
+		codec:   codec,
+		commits: make(chan *commitRequest),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go log.committer()
 	fmt.Printf("Opened raft log with available indexes %d-%d\n", l.FirstIndex(), l.LastIndex())
 	return &log, nil
 }
 
 func (r *RaftLog) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closing)
+	})
+	<-r.closed
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.log.Close()
 }
 
 func (r *RaftLog) FirstIndex() (uint64, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
 	return uint64(r.log.FirstIndex()), nil
 }
 
 func (r *RaftLog) LastIndex() (uint64, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
 	return uint64(r.log.LastIndex()), nil
 }
 
-// GetLog gets a log entry at a given index.
+// GetLog gets a log entry at a given index. GetLog can be called concurrently
+// with other readers and with StoreLogs.
 func (r *RaftLog) GetLog(index uint64, log *raft.Log) error {
-	r.lock.Lock()
 	v, err := r.log.Read(Index(index))
-	r.lock.Unlock()
 	if err != nil {
 		fmt.Printf("error reading log entry %d %v\n", index, err)
-		if strings.Contains(err.Error(), "not available") {
+		if errors.Is(err, ErrIndexBeforeFirst) || errors.Is(err, ErrIndexAfterLast) {
 			return raft.ErrLogNotFound
 		}
 		return err
 	}
-	return gob.NewDecoder(bytes.NewReader(v)).Decode(log)
+	return r.codec.Decode(v, log)
+}
+
+// FindFirstIndexOfTerm returns the index of the first entry with the supplied term, or
+// raft.ErrLogNotFound if there aren't any entries with that term. Each segment records
+// the terms of its first & last entry, so only one segment has to be searched.
+func (r *RaftLog) FindFirstIndexOfTerm(term uint64) (uint64, error) {
+	idx, err := r.log.searchKeys(func(t uint64) bool { return t >= term })
+	if err != nil {
+		return 0, err
+	}
+	return r.checkTerm(idx, term)
+}
+
+// FindLastIndexOfTerm returns the index of the last entry with the supplied term, or
+// raft.ErrLogNotFound if there aren't any entries with that term.
+func (r *RaftLog) FindLastIndexOfTerm(term uint64) (uint64, error) {
+	idx, err := r.log.searchKeys(func(t uint64) bool { return t > term })
+	if err != nil {
+		return 0, err
+	}
+	return r.checkTerm(idx-1, term)
+}
+
+// checkTerm returns idx if the entry at idx has the supplied term.
+func (r *RaftLog) checkTerm(idx Index, term uint64) (uint64, error) {
+	if idx == 0 || idx < r.log.FirstIndex() || idx > r.log.LastIndex() {
+		return 0, raft.ErrLogNotFound
+	}
+	v, err := r.log.Read(idx)
+	if err != nil {
+		return 0, err
+	}
+	t, err := r.log.config.entryKey(v)
+	if err != nil {
+		return 0, err
+	}
+	if t != term {
+		return 0, raft.ErrLogNotFound
+	}
+	return uint64(idx), nil
 }
 
 // StoreLog stores a log entry.
 func (r *RaftLog) StoreLog(log *raft.Log) error {
-	r.lock.Lock()
-	r.buf.Reset()
-	if err := gob.NewEncoder(&r.buf).Encode(log); err != nil {
-		r.lock.Unlock()
+	return r.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores multiple log entries. Concurrent calls are queued and
+// written together by the group commit writer, with a single write and a single
+// fsync (subject to the configured SyncPolicy) for the whole group.
+func (r *RaftLog) StoreLogs(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	req, err := r.enqueue(logs)
+	if err != nil {
 		return err
 	}
-	idx, err := r.log.Append(r.buf.Bytes())
-	r.lock.Unlock()
-	if err == nil && idx != Index(log.Index) {
-		return fmt.Errorf("Log returned unexpected index of %d expecting %d", idx, log.Index)
+	return <-req.err
+}
+
+// enqueue hands logs to the group commit writer, the result is sent to the returned request's err channel.
+func (r *RaftLog) enqueue(logs []*raft.Log) (*commitRequest, error) {
+	req := &commitRequest{logs: logs, err: make(chan error, 1)}
+	select {
+	case r.commits <- req:
+		return req, nil
+	case <-r.closing:
+		return nil, ErrLogClosed
 	}
-	//	fmt.Printf("Wrote log entry %d\n", idx)
-	return err
 }
 
-// StoreLogs stores multiple log entries.
-func (r *RaftLog) StoreLogs(logs []*raft.Log) error {
-	for _, l := range logs {
-		if err := r.StoreLog(l); err != nil {
-			return err
+// committer is the group commit writer. It collects all the StoreLogs requests that
+// are waiting and writes them in one go.
+func (r *RaftLog) committer() {
+	defer close(r.closed)
+	for {
+		select {
+		case req := <-r.commits:
+			group := []*commitRequest{req}
+		gather:
+			for len(group) < maxCommitGroup {
+				select {
+				case req := <-r.commits:
+					group = append(group, req)
+				default:
+					break gather
+				}
+			}
+			r.commitGroup(group)
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// commitGroup writes & syncs the entries from a group of StoreLogs requests. A request
+// that can't be encoded or isn't contiguous with the log is failed on its own, the
+// remaining requests all get the result of the shared write.
+func (r *RaftLog) commitGroup(group []*commitRequest) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var entries [][]byte
+	accepted := group[:0:0]
+	next := uint64(r.log.LastIndex()) + 1
+	for _, req := range group {
+		encoded, err := r.encode(req.logs, next)
+		if err != nil {
+			req.err <- err
+			continue
 		}
+		entries = append(entries, encoded...)
+		next += uint64(len(req.logs))
+		accepted = append(accepted, req)
+	}
+	var err error
+	if len(entries) > 0 {
+		_, _, err = r.log.AppendBatch(entries)
+		r.groups++
 	}
-	return nil
+	for _, req := range accepted {
+		req.err <- err
+	}
+}
+
+// encode encodes each of the logs with the codec. The logs must start at index next and be contiguous.
+func (r *RaftLog) encode(logs []*raft.Log, next uint64) ([][]byte, error) {
+	encoded := make([][]byte, len(logs))
+	for i, l := range logs {
+		if l.Index != next+uint64(i) {
+			return nil, fmt.Errorf("Log has unexpected index of %d expecting %d", l.Index, next+uint64(i))
+		}
+		var err error
+		if encoded[i], err = r.codec.Encode(l); err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+// CompactTo deletes the log entries covered by the most recent snapshot in snaps, keeping
+// the trailing entries up to the snapshot's index.
+func (r *RaftLog) CompactTo(snaps *SnapshotStore, trailing uint64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err := snaps.TrimLog(r.log, trailing)
+	return err
 }
 
 // DeleteRange deletes a range of log entries. The range is inclusive.
@@ -2,8 +2,10 @@ package raftylog
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -75,3 +77,279 @@ func logEq(a, b raft.Log) bool {
 		bytes.Equal(a.Data, b.Data) &&
 		bytes.Equal(a.Extensions, b.Extensions)
 }
+
+func Test_RaftLogGroupCommit(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLog(dir, &Config{MaxSegmentItems: 50}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	const writers = 8
+	const batches = 25
+	const batchSize = 4
+	var order sync.Mutex
+	next := uint64(1)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers*batches)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				logs := make([]*raft.Log, batchSize)
+				// allocate indexes & queue under the lock so requests arrive in index order
+				order.Lock()
+				for i := range logs {
+					logs[i] = &raft.Log{Index: next, Term: 1, Type: raft.LogCommand, Data: []byte{byte(next)}}
+					next++
+				}
+				req, err := log.enqueue(logs)
+				order.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if err := <-req.err; err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	last, _ := log.LastIndex()
+	if last != writers*batches*batchSize {
+		t.Fatalf("Unexpected LastIndex %d", last)
+	}
+	for i := uint64(1); i <= last; i++ {
+		read := raft.Log{}
+		if err := log.GetLog(i, &read); err != nil {
+			t.Fatal(err)
+		}
+		if read.Index != i || !bytes.Equal(read.Data, []byte{byte(i)}) {
+			t.Errorf("Unexpected entry %+v at index %d", read, i)
+		}
+	}
+
+	// while the committer is blocked on a write, requests queue up and are then written
+	// together in one AppendBatch.
+	log.lock.Lock()
+	groups := log.groups
+	first, err := log.enqueue([]*raft.Log{{Index: last + 1, Term: 1}})
+	if err != nil {
+		log.lock.Unlock()
+		t.Fatal(err)
+	}
+	queued := make([]chan error, writers)
+	for w := range queued {
+		queued[w] = make(chan error, 1)
+		go func(w int) {
+			logs := []*raft.Log{{Index: last + 2 + uint64(w), Term: 1}}
+			req, err := log.enqueue(logs)
+			if err != nil {
+				queued[w] <- err
+				return
+			}
+			queued[w] <- <-req.err
+		}(w)
+		// blocked senders are received in the order they arrived, give each one time to
+		// queue so that they're in index order.
+		time.Sleep(5 * time.Millisecond)
+	}
+	log.lock.Unlock()
+	if err := <-first.err; err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, q := range queued {
+		if err := <-q; err != nil {
+			failed++
+		}
+	}
+	log.lock.Lock()
+	groups = log.groups - groups
+	log.lock.Unlock()
+	// the first request is written on its own, the queued ones should share a group
+	if groups != 2 {
+		t.Errorf("Expecting the queued requests to be written in 1 group commit, got %d groups, %d failed", groups-1, failed)
+	}
+}
+
+func Test_RaftLogCommitGroupRejectsGaps(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLog(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	req := func(indexes ...uint64) *commitRequest {
+		r := &commitRequest{err: make(chan error, 1)}
+		for _, i := range indexes {
+			r.logs = append(r.logs, &raft.Log{Index: i, Term: 1, Data: []byte{byte(i)}})
+		}
+		return r
+	}
+	good1 := req(1, 2)
+	gap := req(5)
+	good2 := req(3)
+	log.commitGroup([]*commitRequest{good1, gap, good2})
+	if err := <-good1.err; err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := <-gap.err; err == nil {
+		t.Errorf("Non-contiguous request should of failed")
+	}
+	if err := <-good2.err; err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if last, _ := log.LastIndex(); last != 3 {
+		t.Errorf("Unexpected LastIndex %d", last)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.StoreLog(&raft.Log{Index: 4}); err == nil {
+		t.Errorf("StoreLog after Close should fail")
+	}
+}
+
+func Test_RaftLogConcurrentGetLog(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLog(dir, &Config{MaxSegmentItems: 32, Sync: SyncNever}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	wg := sync.WaitGroup{}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read := raft.Log{}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				last, _ := log.LastIndex()
+				for i := uint64(1); i <= last; i += 7 {
+					if err := log.GetLog(i, &read); err != nil {
+						errs <- err
+						return
+					}
+					if read.Index != i {
+						errs <- fmt.Errorf("GetLog(%d) returned entry with index %d", i, read.Index)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := uint64(1); i <= 500; i += 5 {
+		logs := make([]*raft.Log, 5)
+		for j := range logs {
+			logs[j] = &raft.Log{Index: i + uint64(j), Term: 1, Data: []byte{byte(j)}}
+		}
+		if err := log.StoreLogs(logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func Test_RaftLogFindIndexOfTerm(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{MaxSegmentItems: 7}
+	log, err := OpenLog(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// terms 1-5 have entries 1-5, 6-17, none, 18-37, 38-40
+	terms := []struct{ term, first, last uint64 }{{1, 1, 5}, {2, 6, 17}, {4, 18, 37}, {5, 38, 40}}
+	logs := []*raft.Log{}
+	for _, tc := range terms {
+		for i := tc.first; i <= tc.last; i++ {
+			logs = append(logs, &raft.Log{Index: i, Term: tc.term, Data: []byte{byte(i)}})
+		}
+	}
+	if err := log.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	check := func(log *RaftLog) {
+		t.Helper()
+		for _, tc := range terms {
+			if idx, err := log.FindFirstIndexOfTerm(tc.term); err != nil || idx != tc.first {
+				t.Errorf("FindFirstIndexOfTerm(%d) returned %d %v, expecting %d", tc.term, idx, err, tc.first)
+			}
+			if idx, err := log.FindLastIndexOfTerm(tc.term); err != nil || idx != tc.last {
+				t.Errorf("FindLastIndexOfTerm(%d) returned %d %v, expecting %d", tc.term, idx, err, tc.last)
+			}
+		}
+		for _, term := range []uint64{0, 3, 6} {
+			if idx, err := log.FindFirstIndexOfTerm(term); err != raft.ErrLogNotFound {
+				t.Errorf("FindFirstIndexOfTerm(%d) returned %d %v, expecting ErrLogNotFound", term, idx, err)
+			}
+			if idx, err := log.FindLastIndexOfTerm(term); err != raft.ErrLogNotFound {
+				t.Errorf("FindLastIndexOfTerm(%d) returned %d %v, expecting ErrLogNotFound", term, idx, err)
+			}
+		}
+	}
+	check(log)
+	if keys := log.log.items[1].keys; keys == nil || keys.first != 2 || keys.last != 2 {
+		t.Errorf("Unexpected key range for sealed segment %+v", keys)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the term ranges are kept in the segments' index files
+	log, err = OpenLog(dir, &cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	seg := log.log.items[2]
+	if err := seg.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	if seg.keys == nil || seg.keys.first != 2 || seg.keys.last != 4 {
+		t.Errorf("Unexpected key range loaded from index file %+v", seg.keys)
+	}
+	check(log)
+
+	// removing entries from the end updates the term ranges
+	if err := log.DeleteRange(35, 40); err != nil {
+		t.Fatal(err)
+	}
+	last := log.log.LastIndex()
+	terms = terms[:3]
+	terms[2].last = uint64(last)
+	check(log)
+	if idx, err := log.FindFirstIndexOfTerm(5); err != raft.ErrLogNotFound {
+		t.Errorf("FindFirstIndexOfTerm(5) returned %d %v, expecting ErrLogNotFound", idx, err)
+	}
+
+	// removing entries from the start
+	if err := log.DeleteRange(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	terms = terms[1:]
+	terms[0].first = uint64(log.log.FirstIndex())
+	check(log)
+}
@@ -0,0 +1,219 @@
+package raftylog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// quarantineDirName is the subdirectory of the log directory that Repair moves corrupt
+// segments to.
+const quarantineDirName = "corrupt"
+
+// RepairOptions controls how Repair verifies segments, see VerifyOptions.
+type RepairOptions struct {
+	Decode bool
+	Keys   KeyProvider
+}
+
+// RepairActionType is the kind of change Repair made to a segment.
+type RepairActionType int
+
+const (
+	// RepairQuarantined moved the whole segment to the corrupt subdirectory.
+	RepairQuarantined RepairActionType = iota
+	// RepairTruncated removed the entries from the first bad one on, and renamed the
+	// segment to match what's left.
+	RepairTruncated
+	// RepairRenamed renamed a segment whose filename didn't match its contents.
+	RepairRenamed
+	// RepairRemovedSidecar removed a sidecar index file that didn't match its segment,
+	// it's rebuilt when the segment is next read.
+	RepairRemovedSidecar
+)
+
+func (a RepairActionType) String() string {
+	switch a {
+	case RepairQuarantined:
+		return "Quarantined"
+	case RepairTruncated:
+		return "Truncated"
+	case RepairRenamed:
+		return "Renamed"
+	case RepairRemovedSidecar:
+		return "RemovedSidecar"
+	}
+	return fmt.Sprintf("RepairActionType(%d)", int(a))
+}
+
+// RepairAction is a change Repair made to a segment.
+type RepairAction struct {
+	Segment string // filename of the segment before it was changed
+	Type    RepairActionType
+	NewName string // filename after the change, relative to the log directory
+	Reason  string
+}
+
+// LostRange is a range of indexes that Repair removed from the log. First is 0 if the
+// segment's filename couldn't be parsed, and Last is 0 if it can't be known, e.g. for a
+// torn tail of an unfinished segment.
+type LostRange struct {
+	Segment string
+	First   Index
+	Last    Index
+}
+
+// RepairReport describes everything Repair changed.
+type RepairReport struct {
+	Actions []RepairAction
+	Lost    []LostRange
+}
+
+// Repair salvages what it can from a damaged log in dir, so that it can be opened again.
+// Each segment is verified as VerifyDir does. Segments that can't be read at all, such as
+// those with an unparseable filename or a corrupt header, are moved to the corrupt
+// subdirectory. Segments with a corrupt entry, or a torn tail, are truncated before the
+// bad entry, and segments whose filename doesn't match their contents are renamed. Then
+// the segments are made contiguous as for SegmentCheckLenient, except that discarded
+// segments are quarantined rather than deleted. The returned report lists exactly which
+// indexes were lost, so an operator can decide whether the node needs restoring from a
+// snapshot. The log must not be open while it's repaired.
+func Repair(dir string, opts RepairOptions) (RepairReport, error) {
+	var report RepairReport
+	lockFile, err := lockDir(dir, false)
+	if err != nil {
+		return report, err
+	}
+	defer unlockDir(lockFile)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[f.Name()] = true
+	}
+	verify := VerifyOptions{Decode: opts.Decode, Keys: opts.Keys}
+	for _, f := range files {
+		if f.IsDir() || !isSegmentFile(f.Name()) || names[f.Name()+"z"] {
+			continue
+		}
+		rep, err := verifySegmentFile(context.Background(), dir, f.Name(), -1, &verify)
+		if err != nil {
+			return report, err
+		}
+		if err := report.repairSegment(dir, &rep); err != nil {
+			return report, err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return report, err
+	}
+	// every remaining segment can be opened, now make them contiguous.
+	if files, err = os.ReadDir(dir); err != nil {
+		return report, err
+	}
+	// making the segments contiguous doesn't read any entries, so doesn't need the keys.
+	log := Log{
+		config: Config{
+			SegmentCheck:    SegmentCheckLenient,
+			OnSegmentRepair: report.segmentRepaired,
+			quarantineDir:   path.Join(dir, quarantineDirName),
+			skipDecryption:  true,
+		},
+		dir:   dir,
+		items: make([]*segmentReader, 0, len(files)),
+	}
+	err = log.openSegments(files)
+	log.closeSegments()
+	return report, err
+}
+
+// repairSegment fixes any problems that verifying the segment found.
+func (r *RepairReport) repairSegment(dir string, rep *SegmentReport) error {
+	name := rep.Segment
+	sealed := strings.Contains(name, "-")
+	if rep.BadSidecar {
+		if err := os.Remove(path.Join(dir, indexFilename(name))); err != nil {
+			return err
+		}
+		r.Actions = append(r.Actions, RepairAction{Segment: name, Type: RepairRemovedSidecar, Reason: "sidecar index doesn't match the segment"})
+	}
+	if rep.Err == nil {
+		if !sealed && rep.LastIndex >= rep.FirstIndex {
+			newName := fmt.Sprintf("%020d-%020d.seg", rep.FirstIndex, rep.LastIndex)
+			if err := os.Rename(path.Join(dir, name), path.Join(dir, newName)); err != nil {
+				return err
+			}
+			r.Actions = append(r.Actions, RepairAction{Segment: name, Type: RepairRenamed, NewName: newName, Reason: "unfinished segment"})
+		}
+		return nil
+	}
+	last := rep.LastIndex
+	if !sealed {
+		last = 0 // the entries in a torn tail can't be counted
+	}
+	if rep.BadIndex <= rep.FirstIndex || rep.goodSize == 0 || strings.HasSuffix(name, ".segz") {
+		dest, err := quarantineSegment(dir, name, path.Join(dir, quarantineDirName))
+		if err != nil {
+			return err
+		}
+		r.Actions = append(r.Actions, RepairAction{Segment: name, Type: RepairQuarantined, NewName: path.Join(quarantineDirName, path.Base(dest)), Reason: rep.Err.Error()})
+		r.Lost = append(r.Lost, LostRange{Segment: name, First: rep.FirstIndex, Last: last})
+		return nil
+	}
+	// keep the good entries before BadIndex
+	if err := os.Remove(path.Join(dir, indexFilename(name))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Truncate(path.Join(dir, name), rep.goodSize); err != nil {
+		return err
+	}
+	newName := fmt.Sprintf("%020d-%020d.seg", rep.FirstIndex, rep.BadIndex-1)
+	if newName != name {
+		if err := os.Rename(path.Join(dir, name), path.Join(dir, newName)); err != nil {
+			return err
+		}
+	}
+	action := RepairAction{Segment: name, Type: RepairTruncated, NewName: newName, Reason: rep.Err.Error()}
+	if rep.goodSize == rep.Size {
+		// the segment's content is fine, it just has fewer entries than its filename says.
+		action.Type = RepairRenamed
+	}
+	r.Actions = append(r.Actions, action)
+	if !sealed || rep.BadIndex <= last {
+		r.Lost = append(r.Lost, LostRange{Segment: name, First: rep.BadIndex, Last: last})
+	}
+	return nil
+}
+
+// segmentRepaired records a change made while making the segments contiguous.
+func (r *RepairReport) segmentRepaired(sr SegmentRepair) {
+	a := RepairAction{Segment: sr.Segment, Type: RepairQuarantined, NewName: path.Join(quarantineDirName, sr.Segment), Reason: sr.Reason}
+	if !sr.Removed {
+		first, _, _ := parseSegmentFilename(sr.Segment)
+		a.Type = RepairTruncated
+		a.NewName = fmt.Sprintf("%020d-%020d.seg", first, sr.From-1)
+	}
+	r.Actions = append(r.Actions, a)
+	r.Lost = append(r.Lost, LostRange{Segment: sr.Segment, First: sr.From, Last: sr.To})
+}
+
+// quarantineSegment moves a segment file from dir into qdir, returning its new path. Its
+// sidecar index file is removed.
+func quarantineSegment(dir, filename, qdir string) (string, error) {
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return "", err
+	}
+	dest := path.Join(qdir, filename)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = path.Join(qdir, fmt.Sprintf("%s.%d", filename, i))
+	}
+	os.Remove(path.Join(dir, indexFilename(filename)))
+	return dest, os.Rename(path.Join(dir, filename), dest)
+}
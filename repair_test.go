@@ -0,0 +1,149 @@
+package raftylog
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func Test_Repair(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := testEntries(45)
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, entries)
+	log, err := Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := log.items[4]
+	if err := seg.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	badEntry := seg.offsets[2] + 6
+	log.Close()
+
+	// a corrupt header, a corrupt entry, a segment with fewer entries than its name
+	// says & a file that isn't a segment.
+	corruptByte(t, path.Join(dir, "00000000000000000001-00000000000000000010.seg"), 10)
+	corruptByte(t, path.Join(dir, "00000000000000000041-00000000000000000045.seg"), badEntry)
+	if err := os.Rename(path.Join(dir, "00000000000000000031-00000000000000000040.seg"), path.Join(dir, "00000000000000000031-00000000000000000041.seg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "junk.seg"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, &Config{}, false); err == nil {
+		t.Fatal("Expecting damaged log to fail to open")
+	}
+
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expLost := []LostRange{
+		{Segment: "00000000000000000001-00000000000000000010.seg", First: 1, Last: 10},
+		{Segment: "00000000000000000031-00000000000000000041.seg", First: 41, Last: 41},
+		{Segment: "00000000000000000041-00000000000000000045.seg", First: 43, Last: 45},
+		{Segment: "junk.seg"},
+	}
+	if !reflect.DeepEqual(report.Lost, expLost) {
+		t.Errorf("Unexpected lost ranges\n%+v\n%+v", report.Lost, expLost)
+	}
+	types := map[string]RepairActionType{}
+	for _, a := range report.Actions {
+		types[a.Segment] = a.Type
+	}
+	expTypes := map[string]RepairActionType{
+		"00000000000000000001-00000000000000000010.seg": RepairQuarantined,
+		"00000000000000000031-00000000000000000041.seg": RepairRenamed,
+		"00000000000000000041-00000000000000000045.seg": RepairTruncated,
+		"junk.seg": RepairQuarantined,
+	}
+	if !reflect.DeepEqual(types, expTypes) {
+		t.Errorf("Unexpected repair actions %+v", report.Actions)
+	}
+	quarantined, err := os.ReadDir(path.Join(dir, quarantineDirName))
+	if err != nil || len(quarantined) != 2 {
+		t.Errorf("Expecting 2 quarantined segments, got %v %v", quarantined, err)
+	}
+
+	verify, err := VerifyDir(context.Background(), dir, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify.OK() {
+		t.Errorf("Repaired log doesn't verify %+v", verify)
+	}
+	log, err = Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkRange(t, log, 11, 42, entries)
+}
+
+func Test_RepairGap(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := testEntries(30)
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, entries)
+	if err := os.Remove(path.Join(dir, "00000000000000000011-00000000000000000020.seg")); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []LostRange{{Segment: "00000000000000000001-00000000000000000010.seg", First: 1, Last: 10}}
+	if !reflect.DeepEqual(report.Lost, exp) {
+		t.Errorf("Unexpected lost ranges %+v", report.Lost)
+	}
+	if _, err := os.Stat(path.Join(dir, quarantineDirName, "00000000000000000001-00000000000000000010.seg")); err != nil {
+		t.Errorf("Expecting segment before the gap to be quarantined: %v", err)
+	}
+	log, err := Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkRange(t, log, 21, 30, entries)
+}
+
+func Test_RepairEncryptedWithoutKeys(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	keys := testKeys("a", "a")
+	entries := testEntries(15)
+	cfg := Config{MaxSegmentItems: 5, Encryption: EncryptionAESGCM, Keys: keys}
+	writeTestLog(t, dir, &cfg, entries)
+	log, err := Open(dir, &Config{Keys: keys}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := log.items[2]
+	if err := seg.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	badEntry := seg.offsets[2] + 6
+	log.Close()
+	corruptByte(t, path.Join(dir, "00000000000000000011-00000000000000000015.seg"), badEntry)
+
+	// the hashes are enough to find the corrupt entry, so the keys aren't needed.
+	report, err := Repair(dir, RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []LostRange{{Segment: "00000000000000000011-00000000000000000015.seg", First: 13, Last: 15}}
+	if !reflect.DeepEqual(report.Lost, exp) {
+		t.Errorf("Unexpected lost ranges %+v", report.Lost)
+	}
+	log, err = Open(dir, &Config{Keys: keys}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkRange(t, log, 1, 12, entries)
+}
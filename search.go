@@ -0,0 +1,102 @@
+package raftylog
+
+import (
+	"sort"
+)
+
+// Entries can have a key, a uint64 extracted from their data by Config.entryKey, that's
+// in non decreasing order through the log, e.g. the term of a raft log entry. Each sealed
+// segment records the keys of its first & last entry when its sealed, which lets searchKeys
+// find the segment containing a key without reading any entries, and then it only has to
+// binary search that one segment.
+
+// keyRange is the keys of the first and last entries of a segment.
+type keyRange struct {
+	first uint64
+	last  uint64
+}
+
+// key returns the key of the entry at idx.
+func (s *segmentReader) key(keyOf func([]byte) (uint64, error), idx Index) (uint64, error) {
+	data, err := s.readShared(idx, true)
+	if err != nil {
+		return 0, err
+	}
+	return keyOf(data)
+}
+
+// keyRange returns the keys of the segment's first & last entries. The range of a sealed
+// segment is cached, the caller should hold the log's read lock.
+func (s *segmentReader) keyRange(keyOf func([]byte) (uint64, error)) (keyRange, error) {
+	// loading a sealed segment's offsets also loads any keys from its sidecar index.
+	if err := s.loadOffsets(); err != nil {
+		return keyRange{}, err
+	}
+	s.loadLock.Lock()
+	keys := s.keys
+	s.loadLock.Unlock()
+	if keys != nil {
+		return *keys, nil
+	}
+	first, err := s.key(keyOf, s.firstIndex)
+	if err != nil {
+		return keyRange{}, err
+	}
+	last, err := s.key(keyOf, s.lastIndex)
+	if err != nil {
+		return keyRange{}, err
+	}
+	keys = &keyRange{first: first, last: last}
+	if s.sealed() {
+		s.loadLock.Lock()
+		s.keys = keys
+		s.loadLock.Unlock()
+	}
+	return *keys, nil
+}
+
+// searchKeys returns the first index whose key satisfies pred, or LastIndex+1 if none do.
+// Like sort.Search, pred must be false for some, possibly empty, prefix of the keys and
+// true for the rest. The log must have been opened with Config.entryKey set.
+func (log *Log) searchKeys(pred func(key uint64) bool) (Index, error) {
+	keyOf := log.config.entryKey
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	var err error
+	segIdx := sort.Search(len(log.items), func(i int) bool {
+		s := log.items[i]
+		if err != nil || s.lastIndex < s.firstIndex {
+			// an empty writer segment is after every key
+			return true
+		}
+		keys, e := s.keyRange(keyOf)
+		err = e
+		return err != nil || pred(keys.last)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if segIdx == len(log.items) {
+		return log.lastIndex() + 1, nil
+	}
+	s := log.items[segIdx]
+	i := sort.Search(int(s.lastIndex+1-s.firstIndex), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		key, e := s.key(keyOf, s.firstIndex+Index(i))
+		err = e
+		return err != nil || pred(key)
+	})
+	return s.firstIndex + Index(i), err
+}
+
+// sealKeys records the key range of a segment that's being sealed.
+func (s *segmentReaderWriter) sealKeys() {
+	if s.config.entryKey == nil || s.nextIndex == s.reader.firstIndex {
+		return
+	}
+	if keys, err := s.reader.keyRange(s.config.entryKey); err == nil {
+		s.reader.keys = &keys
+	}
+}
@@ -1,89 +1,172 @@
 package raftylog
 
 import (
+	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"math"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type segmentReader struct {
 	dir        string // directory containing segment
 	filename   string // filename of segment
+	config     *Config
 	firstIndex Index
 	lastIndex  Index
+	header     segmentHeader
+	checksum   Checksum    // algorithm from the header used to hash entries
+	aead       cipher.AEAD // encrypts the segment's entries, nil if its not encrypted
 	f          *os.File
+	mm         []byte // read only mapping of a sealed segment when Config.Mmap is set
 	offsets    []int64
+	loadLock   sync.Mutex  // serializes concurrent readers lazily loading offsets & keys
+	keys       *keyRange   // key range of a sealed segment, if known, see searchKeys
+	repair     *TailRepair // set if a torn tail was truncated when the segment was opened
+
+	// block compressed segments have blocks instead of offsets, see segment_blocks.go
+	blocks           []segmentBlock
+	blockCompression CompressionAlgorithm
+	blockCompressor  compressor
+	blockLock        sync.Mutex // protects block
+	block            *decodedBlock
+}
+
+// TailRepair describes a torn or corrupt tail that was truncated from the end of an
+// unfinished segment when the log was opened, e.g. after a crash mid-append. If the
+// segment's header was incomplete the whole segment is removed, and Offset is 0.
+type TailRepair struct {
+	Segment   string // filename of the repaired segment
+	LastIndex Index  // index of the last good entry left in the segment
+	Offset    int64  // size of the segment file after it was truncated
+	Discarded int64  // number of bytes removed from the end of the segment
+	Reason    string // what was wrong with the first discarded frame
 }
 
 type segmentReaderWriter struct {
-	reader    segmentReader
-	config    Config
-	nextIndex Index
-	fileSize  int64
+	reader     segmentReader
+	config     Config
+	nextIndex  Index
+	fileSize   int64
+	compressor compressor // compresses new entries, nil if Config.Compression is none
+	scratch    []byte     // reused to compress entries
+	sealed     []byte     // reused to encrypt entries
 }
 
-func openSegment(dir, filename string) (*segmentReader, error) {
-	// if the segment was cleanly closed, it'll be named firstIndex-lastIndex
-	// if it wasn't it'll be called firstIndex and we'll have to find the last index ourselves
-	indexes := filename
-	if strings.HasSuffix(filename, ".seg") {
-		indexes = filename[:len(filename)-4]
-	}
+// parseSegmentFilename returns the indexes in a segment's filename. If the segment was
+// cleanly closed, it'll be named firstIndex-lastIndex, if it wasn't it'll be called
+// firstIndex and lastIndex is 0.
+func parseSegmentFilename(filename string) (firstIndex, lastIndex Index, err error) {
+	indexes := strings.TrimSuffix(strings.TrimSuffix(filename, ".segz"), ".seg")
 	parts := strings.SplitN(indexes, "-", 2)
 	fIdx, err := strconv.ParseUint(parts[0], 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	firstIndex := Index(fIdx)
-	lastIndex := Index(0)
 	if len(parts) > 1 {
 		lIdx, err := strconv.ParseUint(parts[1], 10, 64)
 		if err != nil {
-			return nil, err
+			return 0, 0, err
 		}
 		lastIndex = Index(lIdx)
 	}
-	f, err := os.OpenFile(path.Join(dir, filename), os.O_RDWR, 0)
+	return Index(fIdx), lastIndex, nil
+}
+
+func openSegment(dir, filename string, config *Config) (*segmentReader, error) {
+	// if the segment wasn't cleanly closed we'll have to find the last index ourselves
+	firstIndex, lastIndex, err := parseSegmentFilename(filename)
 	if err != nil {
 		return nil, err
 	}
-	idx := Index(0)
-	err = binary.Read(f, binary.LittleEndian, &idx)
+	flag := os.O_RDWR
+	if config.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path.Join(dir, filename), flag, 0)
 	if err != nil {
 		return nil, err
 	}
-	if idx != firstIndex {
-		return nil, errors.New(fmt.Sprintf("Segment %v expected to having starting index %d but was %d", filename, firstIndex, idx))
+	header, err := readSegmentHeader(f, filename, firstIndex)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 	rdr := &segmentReader{
 		dir:        dir,
 		filename:   filename,
+		config:     config,
 		firstIndex: firstIndex,
 		lastIndex:  lastIndex,
+		header:     header,
 		f:          f,
 	}
+	if rdr.checksum, err = checksumFor(header.checksum); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !config.skipDecryption {
+		if rdr.aead, err = segmentCipherFor(&header, config.Keys); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Segment %v can't be decrypted: %v", filename, err)
+		}
+	}
 	if lastIndex == 0 {
-		rdr.index()
-		rdr.lastIndex = rdr.firstIndex + Index(len(rdr.offsets)) - 1
+		// this segment was still being written to, it may have a torn write at the end.
+		if rdr.repair, err = rdr.recover(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if rdr.compressed() {
+		if err := rdr.readBlockIndex(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if err := rdr.mmap(); err != nil {
+		f.Close()
+		return nil, err
 	}
 	return rdr, nil
 }
 
 func newSegment(dir string, config *Config, firstIndex Index) (*segmentReaderWriter, error) {
+	checksum, err := checksumFor(config.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := compressorFor(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	header := newSegmentHeader(firstIndex, checksum.Algorithm(), config.Compression)
+	var aead cipher.AEAD
+	if config.Encryption != EncryptionNone {
+		if aead, err = newSegmentEncryption(&header, config); err != nil {
+			return nil, err
+		}
+	}
 	fn := fmt.Sprintf("%020d.seg", firstIndex)
 	f, err := os.Create(path.Join(dir, fn))
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Write(f, binary.LittleEndian, firstIndex)
+	_, err = f.Write(header.marshal())
+	if err == nil && config.Sync != SyncNever {
+		if err = f.Sync(); err == nil {
+			err = syncDir(dir)
+		}
+	}
 	if err != nil {
+		// don't leave a segment without a header behind, it would be reused by the next writer.
+		f.Close()
+		os.Remove(path.Join(dir, fn))
 		return nil, err
 	}
 	return &segmentReaderWriter{
@@ -91,77 +174,264 @@ func newSegment(dir string, config *Config, firstIndex Index) (*segmentReaderWri
 		reader: segmentReader{
 			dir:        dir,
 			filename:   fn,
+			config:     config,
 			firstIndex: firstIndex,
-			lastIndex:  0,
+			lastIndex:  firstIndex - 1, // empty
+			header:     header,
+			checksum:   checksum,
+			aead:       aead,
 			f:          f,
 		},
-		nextIndex: firstIndex,
-		fileSize:  8,
+		nextIndex:  firstIndex,
+		fileSize:   header.size,
+		compressor: compressor,
 	}, nil
 }
 
 func (s *segmentReader) close() error {
-	err := s.f.Close()
+	err := s.munmap()
+	err2 := s.f.Close()
 	s.f = nil
+	return any(err, err2)
+}
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// mmap maps the segment file into memory if Config.Mmap is set. Only sealed segments
+// are mapped as the mapping doesn't grow with the file.
+func (s *segmentReader) mmap() error {
+	if s.config == nil || !s.config.Mmap || s.mm != nil {
+		return nil
+	}
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	mm, err := mmapFile(s.f, info.Size())
+	if err == nil {
+		s.mm = mm
+	}
+	if err == errMmapUnsupported {
+		return nil
+	}
+	return err
+}
+
+func (s *segmentReader) munmap() error {
+	if s.mm == nil {
+		return nil
+	}
+	err := munmapFile(s.mm)
+	s.mm = nil
 	return err
 }
 
 func (s *segmentReader) read(idx Index) ([]byte, error) {
-	if s.offsets == nil {
-		if err := s.index(); err != nil {
-			return nil, err
-		}
+	return s.readShared(idx, false)
+}
+
+// readShared reads the entry at idx. If shared is true and the segment is memory mapped the
+// returned slice points into the mapping, it must not be modified and is only valid until
+// the segment is closed.
+func (s *segmentReader) readShared(idx Index, shared bool) ([]byte, error) {
+	if err := s.loadOffsets(); err != nil {
+		return nil, err
 	}
 	if idx < s.firstIndex || idx > s.lastIndex {
 		return nil, fmt.Errorf("Segment %v doesn't contain index %d", s, idx)
 	}
-	offset := s.offsets[idx-s.firstIndex]
-	if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+	var body []byte
+	var offset int64
+	var err error
+	if s.blocks != nil {
+		body, offset, err = s.blockFrame(idx)
+	} else if offset = s.offsets[idx-s.firstIndex]; s.mm != nil {
+		body, err = s.mappedFrame(idx, offset)
+	} else {
+		body, err = s.readFrame(offset)
+	}
+	if err != nil {
 		return nil, err
 	}
-	len := uint32(0)
-	if err := binary.Read(s.f, binary.LittleEndian, &len); err != nil {
+	data, aliased, err := s.decodeFrame(idx, offset, body)
+	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, len)
-	if _, err := io.ReadFull(s.f, data); err != nil {
+	if aliased && (s.mm != nil || s.blocks != nil) && !shared {
+		return append([]byte(nil), data...), nil
+	}
+	return data, nil
+}
+
+// decodeFrame validates the frame of the entry at idx and returns its data, decrypting and
+// decompressing it as needed. aliased is true if the returned data points into body.
+func (s *segmentReader) decodeFrame(idx Index, offset int64, body []byte) (data []byte, aliased bool, err error) {
+	flags, data, err := s.checkFrame(body)
+	if err != nil {
+		return nil, false, s.corruptEntry(idx, offset, err)
+	}
+	if flags&frameEncrypted != 0 {
+		if data, err = s.decrypt(idx, data); err != nil {
+			return nil, false, s.corruptEntry(idx, offset, fmt.Errorf("couldn't be decrypted: %v", err))
+		}
+		if flags &^= frameEncrypted; flags == 0 {
+			return data, false, nil
+		}
+	}
+	if flags != 0 {
+		if data, err = decompressEntry(flags, data); err != nil {
+			return nil, false, s.corruptEntry(idx, offset, fmt.Errorf("couldn't be decompressed: %v", err))
+		}
+		return data, false, nil
+	}
+	return data, true, nil
+}
+
+// readFrame reads the frame at offset from the segment file, it returns the frame
+// following its length.
+func (s *segmentReader) readFrame(offset int64) ([]byte, error) {
+	var scratch [4]byte
+	if _, err := s.f.ReadAt(scratch[:], offset); err != nil {
+		return nil, err
+	}
+	vlen := binary.LittleEndian.Uint32(scratch[:])
+	body := make([]byte, frameSize(s.header.version, int(vlen))-4)
+	if _, err := s.f.ReadAt(body, offset+4); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// mappedFrame returns the frame at offset directly from the segment's memory mapping,
+// following its length.
+func (s *segmentReader) mappedFrame(idx Index, offset int64) ([]byte, error) {
+	if offset+4 > int64(len(s.mm)) {
+		return nil, s.corruptEntry(idx, offset, errPastEnd)
+	}
+	vlen := binary.LittleEndian.Uint32(s.mm[offset:])
+	end := offset + int64(frameSize(s.header.version, int(vlen)))
+	if end > int64(len(s.mm)) {
+		return nil, s.corruptEntry(idx, offset, errPastEnd)
+	}
+	return s.mm[offset+4 : end : end], nil
+}
+
+// errPastEnd is the reason for a CorruptEntryError when an entry's length goes past the end of the segment.
+var errPastEnd = errors.New("entry is past the end of the segment")
+
+// corruptEntry returns a *CorruptEntryError for the entry at idx.
+func (s *segmentReader) corruptEntry(idx Index, offset int64, err error) error {
+	return &CorruptEntryError{Segment: s.filename, Offset: offset, Index: idx, Err: err}
+}
+
+// checkFrame validates the hash of a frame, body is the frame following its length. It
+// returns the frame's flags and the entry's data as stored in the segment.
+func (s *segmentReader) checkFrame(body []byte) (byte, []byte, error) {
+	end := len(body) - 8
+	hv := binary.LittleEndian.Uint64(body[end:])
+	if h := s.checksum.Sum64(body[:end]); hv != h {
+		return 0, nil, fmt.Errorf("invalid hash of %x, expecting %x", hv, h)
+	}
+	if frameFlagsSize(s.header.version) == 0 {
+		return 0, body[:end:end], nil
+	}
+	return body[0], body[1:end:end], nil
+}
+
+// recover indexes an unfinished segment, checking that every frame is complete and
+// has a valid hash. Anything after the last good frame is truncated from the file.
+func (s *segmentReader) recover() (*TailRepair, error) {
+	info, err := s.f.Stat()
+	if err != nil {
 		return nil, err
 	}
-	hv := uint64(0)
-	if err := binary.Read(s.f, binary.LittleEndian, &hv); err != nil {
+	size := info.Size()
+	offset := s.header.size
+	r := bufio.NewReader(io.NewSectionReader(s.f, offset, size-offset))
+	offsets := make([]int64, 0, 32)
+	var body []byte
+	var scratch [4]byte
+	reason := ""
+	for offset < size {
+		if offset+4 > size {
+			reason = "incomplete length"
+			break
+		}
+		if _, err := io.ReadFull(r, scratch[:]); err != nil {
+			return nil, err
+		}
+		vlen := binary.LittleEndian.Uint32(scratch[:])
+		fsize := int64(frameSize(s.header.version, int(vlen)))
+		if offset+fsize > size {
+			reason = fmt.Sprintf("incomplete entry of length %d", vlen)
+			break
+		}
+		if int64(cap(body)) < fsize-4 {
+			body = make([]byte, fsize-4)
+		}
+		body = body[:fsize-4]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		if _, _, err := s.checkFrame(body); err != nil {
+			reason = err.Error()
+			break
+		}
+		offsets = append(offsets, offset)
+		offset += fsize
+	}
+	s.offsets = offsets
+	s.lastIndex = s.firstIndex + Index(len(offsets)) - 1
+	if offset >= size || s.config.ReadOnly {
+		// a read only log ignores any bad tail rather than truncating it
+		return nil, nil
+	}
+	if err := s.f.Truncate(offset); err != nil {
 		return nil, err
 	}
-	h := fnv.New64()
-	h.Write(data)
-	if hv != h.Sum64() {
-		return nil, fmt.Errorf("Entry at index %d with offset %d has invalid hash of %x, expecting %x", idx, offset, h.Sum64(), h)
+	if err := s.f.Sync(); err != nil {
+		return nil, err
 	}
-	return data, nil
+	return &TailRepair{
+		Segment:   s.filename,
+		LastIndex: s.lastIndex,
+		Offset:    offset,
+		Discarded: size - offset,
+		Reason:    reason,
+	}, nil
 }
 
 func (s *segmentReader) index() error {
-	offset := int64(8)
-	var err error
+	offsets, err := s.scanOffsets()
+	if err != nil {
+		return err
+	}
+	s.offsets = offsets
+	if s.lastIndex != 0 && Index(len(offsets)) != s.lastIndex-s.firstIndex+1 {
+		return fmt.Errorf("segment %s has unexpected number of entries %d expected %d", s.filename, len(offsets), s.lastIndex-s.firstIndex+1)
+	}
+	return nil
+}
+
+// scanOffsets returns the offset of each entry in the segment file.
+func (s *segmentReader) scanOffsets() ([]int64, error) {
+	offset := s.header.size
 	offsets := make([]int64, 0, 32)
+	var scratch [4]byte
 	for {
-		if offset, err = s.f.Seek(offset, io.SeekStart); err != nil {
-			if err == io.EOF {
-				s.offsets = offsets
-				return nil
-			}
-			return err
-		}
-		vlen := uint32(0)
-		err = binary.Read(s.f, binary.LittleEndian, &vlen)
+		_, err := s.f.ReadAt(scratch[:], offset)
 		if err == io.EOF {
-			s.offsets = offsets
-			if s.lastIndex != 0 && Index(len(offsets)) != s.lastIndex-s.firstIndex+1 {
-				return fmt.Errorf("segment %s has unexpected number of entries %d expected %d", s.filename, len(offsets), s.lastIndex-s.firstIndex+1)
-			}
-			return nil
+			return offsets, nil
 		}
+		if err != nil {
+			return nil, err
+		}
+		vlen := binary.LittleEndian.Uint32(scratch[:])
 		offsets = append(offsets, offset)
-		offset += 4 + int64(vlen) + 8 // len, data, hash
+		offset += int64(frameSize(s.header.version, int(vlen)))
 	}
 }
 
@@ -171,13 +441,18 @@ func (s *segmentReader) String() string {
 
 func (s *segmentReaderWriter) full() bool {
 	// returns true if there shouldn't be any more data appended to this segment
+	return s.fullAt(s.nextIndex, s.fileSize)
+}
+
+// fullAt returns true if the segment would be full once it reached nextIndex & fileSize.
+func (s *segmentReaderWriter) fullAt(nextIndex Index, fileSize int64) bool {
 	if s.config.MaxSegmentItems > 0 {
-		if s.nextIndex-s.reader.firstIndex >= Index(s.config.MaxSegmentItems) {
+		if nextIndex-s.reader.firstIndex >= Index(s.config.MaxSegmentItems) {
 			return true
 		}
 	}
 	if s.config.MaxSegmentFileSize > 0 {
-		if s.fileSize >= s.config.MaxSegmentFileSize {
+		if fileSize >= s.config.MaxSegmentFileSize {
 			return true
 		}
 	}
@@ -185,66 +460,148 @@ func (s *segmentReaderWriter) full() bool {
 }
 
 func (s *segmentReader) rewindTo(idx Index) error {
-	if s.offsets == nil {
-		if err := s.index(); err != nil {
-			return err
-		}
+	if err := s.loadOffsets(); err != nil {
+		return err
 	}
 	offset := s.offsets[idx-s.firstIndex]
-	if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+	if err := s.removeIndexFile(); err != nil {
 		return err
 	}
+	if err := s.munmap(); err != nil {
+		return err
+	}
+	sealed := s.sealed()
+	if sealed {
+		// a sealed segment is renamed back to an unfinished one before its truncated, so
+		// that after a crash part way through, Open counts its entries rather than
+		// trusting the old filename.
+		if err := s.rename(fmt.Sprintf("%020d.seg", s.firstIndex)); err != nil {
+			return err
+		}
+	}
 	if err := os.Truncate(path.Join(s.dir, s.filename), offset); err != nil {
 		return err
 	}
 	s.offsets = s.offsets[:idx-s.firstIndex]
 	s.lastIndex = idx - 1
-	if strings.Index(s.filename, "-") > 0 {
-		oldname := s.filename
-		s.filename = fmt.Sprintf("%020d-%020d.seg", s.firstIndex, s.lastIndex)
-		return os.Rename(path.Join(s.dir, oldname), path.Join(s.dir, s.filename))
+	s.keys = nil
+	if sealed {
+		if err := s.rename(fmt.Sprintf("%020d-%020d.seg", s.firstIndex, s.lastIndex)); err != nil {
+			return err
+		}
+		s.writeIndexFile(offset)
+		return s.mmap()
 	}
 	return nil
 }
 
+// rename renames the segment file to filename, syncing the directory unless the sync
+// policy is SyncNever.
+func (s *segmentReader) rename(filename string) error {
+	if err := os.Rename(path.Join(s.dir, s.filename), path.Join(s.dir, filename)); err != nil {
+		return err
+	}
+	s.filename = filename
+	if s.config != nil && s.config.Sync == SyncNever {
+		return nil
+	}
+	return syncDir(s.dir)
+}
+
 func (s *segmentReader) delete() error {
 	err := s.close()
+	// remove the index first, so that a crash can't leave behind an index without its segment.
+	err3 := s.removeIndexFile()
 	err2 := os.Remove(path.Join(s.dir, s.filename))
 	s.f = nil
-	return any(err2, err)
+	return any(err3, err2, err)
 }
 
-func (s *segmentReaderWriter) append(d []byte) (Index, error) {
-	// 4 bytes for len, then data, then hash
-	offset, err := s.reader.f.Seek(0, io.SeekEnd)
-	if err != nil {
-		return 0, err
-	}
-	if len(d) > math.MaxUint32 {
-		return 0, errors.New("Entry is larger than the maximum supported size")
+// writeBatch writes as many of the entries as fit to the end of the segment file using a
+// single write, and returns their offsets along with the new file size. At least one entry
+// is always written, callers should check full() first. The entries aren't visible to
+// readers until they're published. Only the appender calls writeBatch, so it doesn't need
+// to hold the log's lock.
+func (s *segmentReaderWriter) writeBatch(entries [][]byte) ([]int64, int64, error) {
+	version := s.reader.header.version
+	size := 0
+	for _, d := range entries {
+		size += frameSize(version, len(d))
+	}
+	buf := make([]byte, 0, size)
+	offsets := make([]int64, 0, len(entries))
+	nextIndex := s.nextIndex
+	fileSize := s.fileSize
+	for _, d := range entries {
+		if len(offsets) > 0 && s.fullAt(nextIndex, fileSize) {
+			break
+		}
+		if len(d) > math.MaxUint32 {
+			return nil, 0, errors.New("Entry is larger than the maximum supported size")
+		}
+		stored, flags := compressEntry(s.compressor, s.config.Compression, s.config.CompressionMinSize, s.scratch, d)
+		if flags != 0 {
+			s.scratch = stored[:0]
+		}
+		if s.reader.aead != nil {
+			s.sealed = s.reader.aead.Seal(s.sealed[:0], entryNonce(s.reader.aead, nextIndex), stored, nil)
+			stored = s.sealed
+			flags |= frameEncrypted
+		}
+		offsets = append(offsets, fileSize)
+		buf = appendFrame(buf, version, flags, stored, s.reader.checksum)
+		nextIndex++
+		fileSize += int64(frameSize(version, len(stored)))
 	}
-	l := uint32(len(d))
-	err = binary.Write(s.reader.f, binary.LittleEndian, l)
-	if err != nil {
-		return 0, err
+	if _, err := s.reader.f.WriteAt(buf, s.fileSize); err != nil {
+		return nil, 0, err
 	}
-	_, err = s.reader.f.Write(d)
-	if err != nil {
-		return 0, err
-	}
-	h := fnv.New64()
-	h.Write(d)
-	hv := h.Sum64()
-	err = binary.Write(s.reader.f, binary.LittleEndian, hv)
-	if err != nil {
-		return 0, err
+	return offsets, fileSize, nil
+}
+
+// publish makes entries written by writeBatch visible to readers, the caller should
+// hold the log's write lock.
+func (s *segmentReaderWriter) publish(offsets []int64, fileSize int64) {
+	s.nextIndex += Index(len(offsets))
+	s.reader.offsets = append(s.reader.offsets, offsets...)
+	s.reader.lastIndex = s.nextIndex - 1
+	s.fileSize = fileSize
+}
+
+// frameFlagsSize returns the size of the flags stored with each entry in a segment
+// of the supplied version.
+func frameFlagsSize(version uint16) int {
+	if version < segmentVersion2 {
+		return 0
 	}
-	idx := s.nextIndex
-	s.nextIndex++
-	s.reader.offsets = append(s.reader.offsets, offset)
-	s.reader.lastIndex = idx
-	s.fileSize += (4 + int64(len(d)) + 8)
-	return idx, nil
+	return 1
+}
+
+const (
+	// frameCompressionMask is the part of the frame flags that holds the entry's CompressionAlgorithm.
+	frameCompressionMask = 0x0f
+	// frameEncrypted is set in the frame flags of encrypted entries.
+	frameEncrypted = 0x10
+)
+
+// frameSize returns the number of bytes an entry with n bytes of stored data takes
+// up in a segment of the supplied version.
+func frameSize(version uint16, n int) int {
+	return 4 + frameFlagsSize(version) + n + 8 // len, flags, data, hash
+}
+
+// appendFrame appends the on disk format of entry d to buf.
+func appendFrame(buf []byte, version uint16, flags byte, d []byte, checksum Checksum) []byte {
+	var scratch [8]byte
+	binary.LittleEndian.PutUint32(scratch[:4], uint32(len(d)))
+	buf = append(buf, scratch[:4]...)
+	start := len(buf)
+	if frameFlagsSize(version) > 0 {
+		buf = append(buf, flags)
+	}
+	buf = append(buf, d...)
+	binary.LittleEndian.PutUint64(scratch[:], checksum.Sum64(buf[start:]))
+	return append(buf, scratch[:]...)
 }
 
 func (s *segmentReaderWriter) rewindTo(idx Index) error {
@@ -257,15 +614,33 @@ func (s *segmentReaderWriter) rewindTo(idx Index) error {
 	return nil
 }
 
+// sync fsyncs the segment file.
+func (s *segmentReaderWriter) sync() error {
+	return s.reader.f.Sync()
+}
+
 func (s *segmentReaderWriter) finish() error {
 	last := fmt.Sprintf("%020d-%020d.seg", s.reader.firstIndex, s.nextIndex-1)
+	s.sealKeys()
+	if s.config.Sync != SyncNever {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
 	s.reader.f.Close()
 	err := os.Rename(path.Join(s.reader.dir, s.reader.filename), path.Join(s.reader.dir, last))
 	if err == nil {
 		s.reader.filename = last
+		s.reader.writeIndexFile(s.fileSize)
+		if s.config.Sync != SyncNever {
+			err = syncDir(s.reader.dir)
+		}
 	}
 	var err2 error
 	s.reader.f, err2 = os.Open(path.Join(s.reader.dir, s.reader.filename))
+	if err2 == nil {
+		err2 = s.reader.mmap()
+	}
 	return any(err, err2)
 }
 
@@ -0,0 +1,454 @@
+package raftylog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Block compressed segments
+//
+// When Config.SegmentCompression is set, sealed segments are recompressed in the background
+// into a first-last.segz file, which replaces the original segment. The entries' frames are
+// kept exactly as they were in the original segment, so their hashes still apply, but are
+// grouped into blocks which are compressed together. Reading an entry decompresses its block.
+//
+// The file format is
+//	header   the original segment's header, with segmentFlagBlocks set
+//	blocks   each block is the compressed frames of a run of consecutive entries
+//	index    for each block: offset uint64, length uint32, entries uint32
+//	trailer  indexOffset uint64, blocks uint32, algorithm uint8 (a CompressionAlgorithm),
+//	         3 reserved bytes, crc uint32 CRC-32C of the index & the rest of the trailer
+// All values are little endian.
+//
+// Version 0 segments don't have a header to record this in, so are never compressed, and
+// neither are encrypted segments.
+
+const (
+	// segmentFlagBlocks is set in the header of block compressed segments.
+	segmentFlagBlocks = 1 << 0
+
+	// defaultSegmentBlockSize is used when Config.SegmentBlockSize isn't set.
+	defaultSegmentBlockSize = 64 * 1024
+
+	segmentBlockEntrySize = 8 + 4 + 4 // offset, length, count
+	segmentTrailerSize    = 8 + 4 + 1 + 3 + 4
+)
+
+// segmentBlock is the location of a block of entries in a block compressed segment.
+type segmentBlock struct {
+	offset int64 // offset of the compressed block in the segment file
+	length uint32
+	first  Index // index of the first entry in the block
+}
+
+// decodedBlock is a decompressed block along with the offset of each frame in it.
+type decodedBlock struct {
+	block   int
+	data    []byte
+	offsets []int
+}
+
+// compressed returns true if the segment is a block compressed .segz file.
+func (s *segmentReader) compressed() bool {
+	return strings.HasSuffix(s.filename, ".segz")
+}
+
+// readBlockIndex reads the block index of a block compressed segment.
+func (s *segmentReader) readBlockIndex() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size < s.header.size+segmentTrailerSize {
+		return fmt.Errorf("Segment %v is too short to be block compressed", s.filename)
+	}
+	var trailer [segmentTrailerSize]byte
+	if _, err := s.f.ReadAt(trailer[:], size-segmentTrailerSize); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	indexOffset := int64(le.Uint64(trailer[0:]))
+	count := int64(le.Uint32(trailer[8:]))
+	if indexOffset < s.header.size || indexOffset+count*segmentBlockEntrySize != size-segmentTrailerSize {
+		return fmt.Errorf("Segment %v has a corrupt block index", s.filename)
+	}
+	index := make([]byte, size-indexOffset)
+	if _, err := s.f.ReadAt(index, indexOffset); err != nil {
+		return err
+	}
+	end := len(index) - 4
+	if crc := le.Uint32(index[end:]); crc != crc32.Checksum(index[:end], castagnoli) {
+		return fmt.Errorf("Segment %v has a corrupt block index, invalid crc %x", s.filename, crc)
+	}
+	s.blockCompression = CompressionAlgorithm(trailer[12])
+	if s.blockCompressor, err = compressorFor(s.blockCompression); err != nil || s.blockCompressor == nil {
+		return fmt.Errorf("Segment %v uses unsupported block compression algorithm %d", s.filename, s.blockCompression)
+	}
+	blocks := make([]segmentBlock, count)
+	next := s.firstIndex
+	for i := range blocks {
+		e := index[i*segmentBlockEntrySize:]
+		blocks[i] = segmentBlock{offset: int64(le.Uint64(e)), length: le.Uint32(e[8:]), first: next}
+		next += Index(le.Uint32(e[12:]))
+		if blocks[i].offset < s.header.size || blocks[i].offset+int64(blocks[i].length) > indexOffset {
+			return fmt.Errorf("Segment %v has a corrupt block index", s.filename)
+		}
+	}
+	if next != s.lastIndex+1 {
+		return fmt.Errorf("Segment %v has a block index with %d entries, expecting %d", s.filename, next-s.firstIndex, s.lastIndex-s.firstIndex+1)
+	}
+	s.blocks = blocks
+	return nil
+}
+
+// blockFrame returns the frame of the entry idx following its length, along with the
+// offset of the block containing it.
+func (s *segmentReader) blockFrame(idx Index) ([]byte, int64, error) {
+	b := sort.Search(len(s.blocks), func(i int) bool {
+		return s.blocks[i].first > idx
+	}) - 1
+	block, err := s.loadBlock(b)
+	if errors.Is(err, errCorruptBlock) {
+		return nil, s.blocks[b].offset, s.corruptEntry(idx, s.blocks[b].offset, err)
+	}
+	if err != nil {
+		return nil, s.blocks[b].offset, err
+	}
+	start := block.offsets[idx-s.blocks[b].first]
+	vlen := binary.LittleEndian.Uint32(block.data[start:])
+	end := start + frameSize(s.header.version, int(vlen))
+	return block.data[start+4 : end : end], s.blocks[b].offset, nil
+}
+
+// errCorruptBlock is returned by loadBlock when a block can't be decoded.
+var errCorruptBlock = errors.New("block is corrupt")
+
+// loadBlock returns block b decompressed. The most recently used block is cached, the
+// returned data is never modified so remains valid after its evicted from the cache.
+func (s *segmentReader) loadBlock(b int) (*decodedBlock, error) {
+	s.blockLock.Lock()
+	cached := s.block
+	s.blockLock.Unlock()
+	if cached != nil && cached.block == b {
+		return cached, nil
+	}
+	blk := s.blocks[b]
+	z := make([]byte, blk.length)
+	if _, err := s.f.ReadAt(z, blk.offset); err != nil {
+		return nil, err
+	}
+	data, err := s.blockCompressor.decompress(z)
+	if err != nil {
+		return nil, fmt.Errorf("%w, it couldn't be decompressed: %v", errCorruptBlock, err)
+	}
+	count := int(s.lastIndex + 1 - blk.first)
+	if b+1 < len(s.blocks) {
+		count = int(s.blocks[b+1].first - blk.first)
+	}
+	decoded := &decodedBlock{block: b, data: data, offsets: make([]int, 0, count)}
+	for offset := 0; offset < len(data); {
+		if offset+4 > len(data) {
+			break
+		}
+		decoded.offsets = append(decoded.offsets, offset)
+		offset += frameSize(s.header.version, int(binary.LittleEndian.Uint32(data[offset:])))
+		if offset > len(data) {
+			decoded.offsets = nil
+			break
+		}
+	}
+	if len(decoded.offsets) != count {
+		return nil, errCorruptBlock
+	}
+	s.blockLock.Lock()
+	s.block = decoded
+	s.blockLock.Unlock()
+	return decoded, nil
+}
+
+// compressSegment writes a block compressed copy of the sealed segment filename to a temp
+// file, and returns the filename the copy should have. Its safe to call while the log is in
+// use, the caller should verify the segment wasn't changed before installing the copy with
+// installCompressedSegment, or removing it with removeCompressedSegment.
+func compressSegment(dir, filename string, config *Config) (string, error) {
+	src, err := openSegment(dir, filename, &Config{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer src.close()
+	if src.header.version == segmentVersion0 {
+		return "", fmt.Errorf("Segment %v is version 0 and can't be block compressed", filename)
+	}
+	c, err := compressorFor(config.SegmentCompression)
+	if err != nil || c == nil {
+		return "", fmt.Errorf("Unsupported block compression algorithm %v", config.SegmentCompression)
+	}
+	blockSize := config.SegmentBlockSize
+	if blockSize <= 0 {
+		blockSize = defaultSegmentBlockSize
+	}
+	info, err := src.f.Stat()
+	if err != nil {
+		return "", err
+	}
+	dest := strings.TrimSuffix(filename, ".seg") + ".segz"
+	tmp := path.Join(dir, compressedTempFilename(dest))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	header := src.header
+	header.flags |= segmentFlagBlocks
+	w := bufio.NewWriter(f)
+	hb := header.marshal()
+	if _, err := w.Write(hb); err != nil {
+		return "", err
+	}
+	offset := int64(len(hb))
+	var index []byte
+	var block, z []byte
+	count := uint32(0)
+	le := binary.LittleEndian
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		z = c.compress(z[:0], block)
+		if _, err := w.Write(z); err != nil {
+			return err
+		}
+		var e [segmentBlockEntrySize]byte
+		le.PutUint64(e[0:], uint64(offset))
+		le.PutUint32(e[8:], uint32(len(z)))
+		le.PutUint32(e[12:], count)
+		index = append(index, e[:]...)
+		offset += int64(len(z))
+		block = block[:0]
+		count = 0
+		return nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(src.f, src.header.size, info.Size()-src.header.size))
+	entries := src.lastIndex - src.firstIndex + 1
+	pos := src.header.size // offset of the current entry in src
+	for i := Index(0); i < entries; i++ {
+		var scratch [4]byte
+		if _, err := io.ReadFull(r, scratch[:]); err != nil {
+			return "", err
+		}
+		start := len(block)
+		block = append(block, scratch[:]...)
+		fsize := frameSize(src.header.version, int(le.Uint32(scratch[:])))
+		block = append(block, make([]byte, fsize-4)...)
+		if _, err := io.ReadFull(r, block[start+4:]); err != nil {
+			return "", err
+		}
+		if _, _, err := src.checkFrame(block[start+4:]); err != nil {
+			return "", src.corruptEntry(src.firstIndex+i, pos, err)
+		}
+		pos += int64(fsize)
+		count++
+		if len(block) >= blockSize {
+			if err := flush(); err != nil {
+				return "", err
+			}
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return "", fmt.Errorf("Segment %v has unexpected data after its last entry", filename)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	var trailer [segmentTrailerSize - 4]byte
+	le.PutUint64(trailer[0:], uint64(offset))
+	le.PutUint32(trailer[8:], uint32(len(index)/segmentBlockEntrySize))
+	trailer[12] = byte(config.SegmentCompression)
+	index = append(index, trailer[:]...)
+	var crc [4]byte
+	le.PutUint32(crc[:], crc32.Checksum(index, castagnoli))
+	index = append(index, crc[:]...)
+	if _, err := w.Write(index); err != nil {
+		return "", err
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dest, nil
+}
+
+// compressedTempFilename is the temp file compressSegment writes the segment dest to.
+func compressedTempFilename(dest string) string {
+	return dest + ".tmp"
+}
+
+// installCompressedSegment renames the copy written by compressSegment to dest. Once
+// installed the original segment is ignored by Open, so the caller should hold the log's
+// lock and have checked the original hasn't changed.
+func installCompressedSegment(dir, dest string) error {
+	tmp := path.Join(dir, compressedTempFilename(dest))
+	if err := os.Rename(tmp, path.Join(dir, dest)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// removeCompressedSegment removes the copy written by compressSegment to dest.
+func removeCompressedSegment(dir, dest string) error {
+	return os.Remove(path.Join(dir, compressedTempFilename(dest)))
+}
+
+// decompressSegment writes an uncompressed copy of the block compressed segment s, and
+// returns its filename.
+func (s *segmentReader) decompressSegment() (string, error) {
+	if s.blocks == nil {
+		return "", errors.New("Segment isn't block compressed")
+	}
+	header := s.header
+	header.flags &^= segmentFlagBlocks
+	buf := header.marshal()
+	for b := range s.blocks {
+		block, err := s.loadBlock(b)
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, block.data...)
+	}
+	dest := strings.TrimSuffix(s.filename, ".segz") + ".seg"
+	if err := writeFileAtomic(path.Join(s.dir, dest), buf); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// startCompressor starts the background compression of sealed segments if its enabled.
+func (log *Log) startCompressor() {
+	if log.config.SegmentCompression == CompressionNone || log.config.ReadOnly {
+		return
+	}
+	log.compressWake = make(chan struct{}, 1)
+	log.compressStop = make(chan struct{})
+	log.compressDone = make(chan struct{})
+	go log.compressSegments()
+	log.wakeCompressor()
+}
+
+// wakeCompressor tells the background compressor to look for segments to compress.
+func (log *Log) wakeCompressor() {
+	select {
+	case log.compressWake <- struct{}{}:
+	default:
+	}
+}
+
+// stopCompressor stops the background compressor and waits for it to finish.
+func (log *Log) stopCompressor() {
+	log.stopOnce.Do(func() {
+		if log.compressStop != nil {
+			close(log.compressStop)
+			<-log.compressDone
+		}
+	})
+}
+
+// compressSegments is the background compressor, each time its woken it compresses any
+// sealed segments that are eligible, oldest first.
+func (log *Log) compressSegments() {
+	defer close(log.compressDone)
+	failed := make(map[string]bool)
+	for {
+		select {
+		case <-log.compressStop:
+			return
+		case <-log.compressWake:
+		}
+		for {
+			select {
+			case <-log.compressStop:
+				return
+			default:
+			}
+			seg, filename := log.nextToCompress(failed)
+			if seg == nil {
+				break
+			}
+			if err := log.compressSegment(seg, filename); err != nil {
+				failed[filename] = true
+				if log.config.OnSegmentCompressionError != nil {
+					log.config.OnSegmentCompressionError(filename, err)
+				}
+			}
+		}
+	}
+}
+
+// nextToCompress returns the oldest sealed segment that should be compressed along with
+// its filename, or nil if there aren't any.
+func (log *Log) nextToCompress(skip map[string]bool) (*segmentReader, string) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	end := len(log.items) - log.config.UncompressedSegments
+	if log.writer != nil {
+		end--
+	}
+	for i := 0; i < end; i++ {
+		s := log.items[i]
+		// encrypted entries don't compress
+		if s.sealed() && !s.compressed() && s.header.version != segmentVersion0 && s.aead == nil && !skip[s.filename] {
+			return s, s.filename
+		}
+	}
+	return nil, ""
+}
+
+// compressSegment replaces seg with a block compressed copy. The copy is made without
+// holding any locks, and is discarded if seg was changed in the meantime.
+func (log *Log) compressSegment(seg *segmentReader, filename string) error {
+	dest, err := compressSegment(log.dir, filename, &log.config)
+	if err != nil {
+		return err
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	for i, item := range log.items {
+		if item == seg && item.filename == filename {
+			if err := installCompressedSegment(log.dir, dest); err != nil {
+				return err
+			}
+			compressed, err := openSegment(log.dir, dest, &log.config)
+			if err != nil {
+				os.Remove(path.Join(log.dir, dest))
+				return err
+			}
+			log.items[i] = compressed
+			log.changes++
+			return seg.delete()
+		}
+	}
+	// seg was deleted or rewound while it was being compressed.
+	return removeCompressedSegment(log.dir, dest)
+}
@@ -0,0 +1,239 @@
+package raftylog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it returns true, failing the test if it takes too long.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func compressedSegments(log *Log) int {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	n := 0
+	for _, s := range log.items {
+		if s.compressed() {
+			n++
+		}
+	}
+	return n
+}
+
+func checkEntries(t *testing.T, log *Log, entries [][]byte) {
+	t.Helper()
+	for i, exp := range entries {
+		act, err := log.Read(Index(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(exp, act) {
+			t.Errorf("Entry %d didn't round trip", i+1)
+		}
+	}
+}
+
+func Test_LogSegmentCompression(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	cfg := Config{
+		MaxSegmentItems:      10,
+		SegmentCompression:   CompressionZstd,
+		SegmentBlockSize:     1024,
+		UncompressedSegments: 1,
+		OnSegmentCompressionError: func(segment string, err error) {
+			t.Errorf("Failed to compress %v: %v", segment, err)
+		},
+	}
+	log, err := Open(dir, &cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(55)
+	for _, e := range entries {
+		if _, err := log.Append(e); err != nil {
+			t.Fatal(err)
+		}
+		// read while the compressor is running
+		checkEntries(t, log, entries[:1])
+	}
+	// 5 sealed segments, the most recent of which is left uncompressed
+	waitFor(t, func() bool { return compressedSegments(log) == 4 })
+	checkEntries(t, log, entries)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "00000000000000000001-") {
+			names = append(names, f.Name())
+		}
+	}
+	if len(names) != 1 || names[0] != "00000000000000000001-00000000000000000010.segz" {
+		t.Errorf("Unexpected files for the first segment %v", names)
+	}
+	if len(log.items[0].blocks) < 2 {
+		t.Errorf("Expecting segment to be split into multiple blocks, got %d", len(log.items[0].blocks))
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed segments are readable without SegmentCompression set
+	log, err = Open(dir, &Config{MaxSegmentItems: 10}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkEntries(t, log, entries)
+
+	// rewinding into a compressed segment decompresses it
+	if err := log.RewindTo(15); err != nil {
+		t.Fatal(err)
+	}
+	if log.items[1].compressed() || log.LastIndex() != 14 {
+		t.Errorf("Unexpected state after rewind %v %d", log.items[1], log.LastIndex())
+	}
+	entries = append(entries[:14], []byte("new"))
+	if _, err := log.Append(entries[14]); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, log, entries)
+	if err := log.DeleteTo(11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "00000000000000000001-00000000000000000010.segz")); !os.IsNotExist(err) {
+		t.Errorf("Compressed segment should of been deleted, %v", err)
+	}
+}
+
+func Test_LogSegmentCompressionCrash(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(25)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	fn := log.items[0].filename
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash after the compressed copy was written, but before the original was removed
+	dest, err := compressSegment(dir, fn, &Config{SegmentCompression: CompressionS2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := installCompressedSegment(dir, dest); err != nil {
+		t.Fatal(err)
+	}
+	// and a crash part way through compressing a segment
+	tmp := path.Join(dir, strings.Replace(dest, "0001-", "0011-", 1)+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	log, err = Open(dir, &Config{MaxSegmentItems: 10}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	checkEntries(t, log, entries)
+	if !log.items[0].compressed() {
+		t.Errorf("Expecting the compressed segment to be used")
+	}
+	for _, f := range []string{fn, tmp} {
+		if _, err := os.Stat(path.Join(dir, path.Base(f))); !os.IsNotExist(err) {
+			t.Errorf("File %v should of been removed, %v", f, err)
+		}
+	}
+}
+
+func Test_SegmentBlockIndexCorrupt(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	seg, err := newSegment(dir, &config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testEntries(10) {
+		if _, _, err := appendEntries(seg, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.finish(); err != nil {
+		t.Fatal(err)
+	}
+	seg.reader.close()
+	dest, err := compressSegment(dir, seg.reader.filename, &Config{SegmentCompression: CompressionSnappy, SegmentBlockSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := installCompressedSegment(dir, dest); err != nil {
+		t.Fatal(err)
+	}
+	fn := path.Join(dir, dest)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-segmentTrailerSize-1]++
+	if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSegment(dir, dest, &config); err == nil || !strings.Contains(err.Error(), "corrupt block index") {
+		t.Errorf("Expecting corrupt block index error, got %v", err)
+	}
+}
+
+func Test_LogSegmentCompressionRewound(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testEntries(25)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	// the copy isn't installed until the compressor has checked the segment is unchanged, so
+	// a crash after a rewind can't bring back the removed entries.
+	dest, err := compressSegment(dir, log.items[0].filename, &Config{SegmentCompression: CompressionS2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, dest)); !os.IsNotExist(err) {
+		t.Errorf("Compressed segment shouldn't exist until its installed, %v", err)
+	}
+	if err := log.RewindTo(5); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, log)
+	log, err = Open(dir, &Config{MaxSegmentItems: 10}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.LastIndex() != 4 {
+		t.Errorf("Unexpected LastIndex %d after rewind", log.LastIndex())
+	}
+	checkEntries(t, log, entries[:4])
+}
@@ -0,0 +1,220 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Segment file format
+//
+// Version 0 segments, written by older versions of raftylog, start with just the
+// 8 byte little endian index of the first entry in the segment.
+//
+// From version 1, segments start with a header
+//	magic        [8]byte "RAFTYSEG"
+//	version      uint16  format version of the segment
+//	headerLen    uint16  size of the header in bytes, including the crc
+//	checksum     uint8   algorithm used for the entry hashes, see ChecksumAlgorithm
+//	compression  uint8   Config.Compression when the segment was created, see CompressionAlgorithm
+//	flags        uint16  reserved, currently 0
+//	firstIndex   uint64  index of the first entry in the segment
+//	created      int64   time the segment was created, nanoseconds since the unix epoch
+// version 3 adds
+//	encryption   uint8   algorithm used to encrypt entries, see EncryptionAlgorithm
+//	keyIDLen     uint8   length of the key id
+//	keyID        [keyIDLen]byte id of the KeyProvider key used to derive the segment's key
+//	salt         [16]byte random salt used to derive the segment's key
+// and then finally
+//	crc          uint32  CRC-32C of all the preceding header bytes
+// All values are little endian. The entries follow the header, each one stored as
+//	len          uint32  length of the entry's data
+//	flags        uint8   how the entry is stored, the low 4 bits are its CompressionAlgorithm
+//	                     and 0x10 is set if its encrypted
+//	data         [len]byte
+//	hash         uint64  hash of flags & data
+// Segments before version 2 don't have the flags, their entries are never compressed and
+// the hash covers just the data. Entries are compressed before being encrypted, and the
+// hash covers the encrypted data, so a log can be checked for corruption without its keys.
+//
+// Upgrading
+//
+// The version is only increased for changes that older readers can't understand. Fields
+// that older readers can safely ignore may be added to the end of the header without
+// changing the version, readers use headerLen to find the first entry. A segment with a
+// version newer than the reader supports fails to open rather than being misread.
+//
+// Existing segments are never rewritten to a newer version, new segments are always
+// written using the current version. Older segments continue to be readable alongside
+// them, and a log is fully upgraded once DeleteTo has removed its last older segment.
+// In particular version 0 segments are recognized by their first 8 bytes matching the
+// first index from the segment's filename instead of the magic.
+
+const (
+	segmentVersion0 = 0
+	segmentVersion1 = 1
+	segmentVersion2 = 2 // adds per entry flags
+	segmentVersion3 = 3 // adds encryption
+	// currentSegmentVersion is the version used for new segments.
+	currentSegmentVersion = segmentVersion3
+
+	// segmentHeaderV1Len is the size of the version 1 header.
+	segmentHeaderV1Len = 8 + 2 + 2 + 1 + 1 + 2 + 8 + 8 + 4
+	// segmentHeaderV3Len is the size of the version 3 header without a key id.
+	segmentHeaderV3Len = segmentHeaderV1Len + 1 + 1 + segmentSaltLen
+)
+
+var segmentMagic = []byte("RAFTYSEG")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type segmentHeader struct {
+	version     uint16
+	size        int64 // size of the header in bytes, the first entry starts at this offset
+	checksum    ChecksumAlgorithm
+	compression CompressionAlgorithm
+	flags       uint16
+	firstIndex  Index
+	created     time.Time
+	encryption  EncryptionAlgorithm
+	keyID       string
+	salt        [segmentSaltLen]byte
+}
+
+// newSegmentHeader returns the header for a new segment starting at firstIndex.
+func newSegmentHeader(firstIndex Index, checksum ChecksumAlgorithm, compression CompressionAlgorithm) segmentHeader {
+	return segmentHeader{
+		version:     currentSegmentVersion,
+		size:        segmentHeaderV3Len,
+		checksum:    checksum,
+		compression: compression,
+		firstIndex:  firstIndex,
+		created:     time.Now(),
+	}
+}
+
+// setEncryption sets the encryption fields of a new header.
+func (h *segmentHeader) setEncryption(a EncryptionAlgorithm, keyID string, salt [segmentSaltLen]byte) error {
+	if len(keyID) > 255 {
+		return fmt.Errorf("Key id %q is too long", keyID)
+	}
+	h.encryption = a
+	h.keyID = keyID
+	h.salt = salt
+	h.size = int64(segmentHeaderV3Len + len(keyID))
+	return nil
+}
+
+// marshal returns the on disk format of the header.
+func (h *segmentHeader) marshal() []byte {
+	size := segmentHeaderV1Len
+	if h.version >= segmentVersion3 {
+		size = segmentHeaderV3Len + len(h.keyID)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, segmentMagic...)
+	var scratch [8]byte
+	le := binary.LittleEndian
+	le.PutUint16(scratch[:], h.version)
+	b = append(b, scratch[:2]...)
+	le.PutUint16(scratch[:], uint16(size))
+	b = append(b, scratch[:2]...)
+	b = append(b, byte(h.checksum), byte(h.compression))
+	le.PutUint16(scratch[:], h.flags)
+	b = append(b, scratch[:2]...)
+	le.PutUint64(scratch[:], uint64(h.firstIndex))
+	b = append(b, scratch[:]...)
+	le.PutUint64(scratch[:], uint64(h.created.UnixNano()))
+	b = append(b, scratch[:]...)
+	if h.version >= segmentVersion3 {
+		b = append(b, byte(h.encryption), byte(len(h.keyID)))
+		b = append(b, h.keyID...)
+		b = append(b, h.salt[:]...)
+	}
+	le.PutUint32(scratch[:], crc32.Checksum(b, castagnoli))
+	return append(b, scratch[:4]...)
+}
+
+// errIncompleteHeader is returned by readSegmentHeader if the segment file ends before the
+// end of its header, e.g. after a crash while a new segment was being created.
+var errIncompleteHeader = errors.New("incomplete header")
+
+// readHeaderAt reads len(b) bytes of the header of segment filename from offset.
+func readHeaderAt(r io.ReaderAt, filename string, b []byte, offset int64) error {
+	n, err := r.ReadAt(b, offset)
+	if n == len(b) {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("Segment %v has an %w", filename, errIncompleteHeader)
+	}
+	return fmt.Errorf("Segment %v header can't be read: %w", filename, err)
+}
+
+// readSegmentHeader reads and validates the header of a segment that's expected to start
+// at firstIndex. Version 0 segments are returned as a header with version 0.
+func readSegmentHeader(r io.ReaderAt, filename string, firstIndex Index) (segmentHeader, error) {
+	var start [8]byte
+	if err := readHeaderAt(r, filename, start[:], 0); err != nil {
+		return segmentHeader{}, err
+	}
+	if !bytes.Equal(start[:], segmentMagic) {
+		if idx := Index(binary.LittleEndian.Uint64(start[:])); idx != firstIndex {
+			return segmentHeader{}, fmt.Errorf("Segment %v expected to having starting index %d but was %d", filename, firstIndex, idx)
+		}
+		return segmentHeader{version: segmentVersion0, size: 8, checksum: ChecksumFNV64, firstIndex: firstIndex}, nil
+	}
+	var fixed [12]byte
+	if err := readHeaderAt(r, filename, fixed[:], 8); err != nil {
+		return segmentHeader{}, err
+	}
+	le := binary.LittleEndian
+	h := segmentHeader{
+		version: le.Uint16(fixed[0:]),
+		size:    int64(le.Uint16(fixed[2:])),
+	}
+	if h.version > currentSegmentVersion {
+		return segmentHeader{}, fmt.Errorf("Segment %v has version %d, the newest supported version is %d", filename, h.version, currentSegmentVersion)
+	}
+	if h.size < segmentHeaderV1Len {
+		return segmentHeader{}, fmt.Errorf("Segment %v has invalid header length %d", filename, h.size)
+	}
+	b := make([]byte, h.size)
+	if err := readHeaderAt(r, filename, b, 0); err != nil {
+		return segmentHeader{}, err
+	}
+	if crc := le.Uint32(b[h.size-4:]); crc != crc32.Checksum(b[:h.size-4], castagnoli) {
+		return segmentHeader{}, fmt.Errorf("Segment %v has a corrupt header, invalid crc %x", filename, crc)
+	}
+	h.checksum = ChecksumAlgorithm(b[12])
+	h.compression = CompressionAlgorithm(b[13])
+	h.flags = le.Uint16(b[14:])
+	h.firstIndex = Index(le.Uint64(b[16:]))
+	h.created = time.Unix(0, int64(le.Uint64(b[24:])))
+	if h.version >= segmentVersion3 {
+		keyIDLen := int64(b[33])
+		if h.size < segmentHeaderV3Len+keyIDLen {
+			return segmentHeader{}, fmt.Errorf("Segment %v has invalid header length %d", filename, h.size)
+		}
+		h.encryption = EncryptionAlgorithm(b[32])
+		h.keyID = string(b[34 : 34+keyIDLen])
+		copy(h.salt[:], b[34+keyIDLen:])
+	}
+	if h.firstIndex != firstIndex {
+		return segmentHeader{}, fmt.Errorf("Segment %v expected to having starting index %d but was %d", filename, firstIndex, h.firstIndex)
+	}
+	if _, err := checksumFor(h.checksum); err != nil || h.checksum == ChecksumDefault {
+		return segmentHeader{}, fmt.Errorf("Segment %v uses unsupported checksum algorithm %d", filename, h.checksum)
+	}
+	if h.encryption > EncryptionChaCha20Poly1305 {
+		return segmentHeader{}, fmt.Errorf("Segment %v uses unsupported encryption algorithm %d", filename, h.encryption)
+	}
+	if _, err := compressorFor(h.compression); err != nil {
+		return segmentHeader{}, fmt.Errorf("Segment %v uses unsupported compression algorithm %d", filename, h.compression)
+	}
+	return h, nil
+}
@@ -0,0 +1,144 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_SegmentHeaderRoundTrip(t *testing.T) {
+	h := newSegmentHeader(42, ChecksumCRC32C, CompressionZstd)
+	b := h.marshal()
+	if len(b) != segmentHeaderV3Len || int64(len(b)) != h.size {
+		t.Errorf("Unexpected header length %d", len(b))
+	}
+	act, err := readSegmentHeader(bytes.NewReader(b), "test.seg", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.version != currentSegmentVersion || act.size != h.size || act.checksum != ChecksumCRC32C ||
+		act.compression != CompressionZstd || act.firstIndex != 42 || !act.created.Equal(h.created) {
+		t.Errorf("Header didn't round trip\n%+v\n%+v", h, act)
+	}
+	if _, err := readSegmentHeader(bytes.NewReader(b), "test.seg", 41); err == nil {
+		t.Errorf("Header with wrong first index should fail")
+	}
+}
+
+func Test_SegmentHeaderInvalid(t *testing.T) {
+	h := newSegmentHeader(1, ChecksumCRC32C, CompressionNone)
+	cases := []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    string
+	}{
+		{"badCrc", func(b []byte) []byte {
+			b[20]++
+			return b
+		}, "corrupt header"},
+		{"newerVersion", func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[8:], currentSegmentVersion+1)
+			return b
+		}, "newest supported version"},
+		{"shortHeaderLen", func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[10:], 10)
+			return b
+		}, "invalid header length"},
+		{"notASegment", func(b []byte) []byte {
+			return []byte("some random bytes that aren't a segment")
+		}, "expected to having starting index"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.modify(h.marshal())
+			_, err := readSegmentHeader(bytes.NewReader(b), "test.seg", 1)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Expecting error containing %q, but got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func Test_SegmentHeaderExtended(t *testing.T) {
+	// a header with extra fields added by a later minor revision should still be readable
+	h := newSegmentHeader(7, ChecksumCRC32C, CompressionNone)
+	b := h.marshal()
+	b = append(b[:len(b)-4], 1, 2, 3, 4, 5, 6)
+	binary.LittleEndian.PutUint16(b[10:], uint16(len(b)+4))
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(b, castagnoli))
+	b = append(b, crc[:]...)
+	act, err := readSegmentHeader(bytes.NewReader(b), "test.seg", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.size != int64(len(b)) {
+		t.Errorf("Unexpected header size %d, expecting %d", act.size, len(b))
+	}
+}
+
+// writeV0Segment writes a segment in the original headerless format.
+func writeV0Segment(t *testing.T, dir string, first Index, entries [][]byte, sealed bool) string {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(first))
+	for _, e := range entries {
+		b = appendFrame(b, segmentVersion0, 0, e, fnv64Checksum{})
+	}
+	fn := fmt.Sprintf("%020d.seg", first)
+	if sealed {
+		fn = fmt.Sprintf("%020d-%020d.seg", first, first+Index(len(entries))-1)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, fn), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func Test_LogReadsV0Segments(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	entries := [][]byte{{1}, {2}, {3}}
+	writeV0Segment(t, dir, 1, entries, true)
+	writeV0Segment(t, dir, 4, entries, false)
+	log, err := Open(dir, &Config{MaxSegmentItems: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.LastIndex() != 6 {
+		t.Fatalf("Unexpected LastIndex %d", log.LastIndex())
+	}
+	if _, err := log.Append([]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if log.items[0].header.version != segmentVersion0 || log.items[2].header.version != currentSegmentVersion {
+		t.Errorf("Unexpected segment versions %d %d", log.items[0].header.version, log.items[2].header.version)
+	}
+	for i := Index(1); i <= 7; i++ {
+		d, err := log.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := []byte{byte((i-1)%3 + 1)}; i < 7 && !bytes.Equal(d, exp) {
+			t.Errorf("Unexpected data %v for index %d", d, i)
+		}
+	}
+	if err := log.RewindTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log, err = Open(dir, &Config{MaxSegmentItems: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.LastIndex() != 2 {
+		t.Errorf("Unexpected LastIndex %d after rewinding a v0 segment", log.LastIndex())
+	}
+}
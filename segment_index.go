@@ -0,0 +1,158 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// A sealed segment has a sidecar .idx file containing the offset of each entry, so that
+// the segment doesn't need to be scanned the first time its read from after opening.
+//
+// The sidecar file format is
+//	magic     "RLIX"
+//	count     uvarint number of entries
+//	size      uvarint size of the segment file
+//	offsets   count uvarints, each the delta from the previous entry's offset
+//	keys      optional, uvarint key of the first entry & uvarint key of the last entry
+//	checksum  uint64 FNV-1a hash of all the preceding bytes
+//
+// The keys are only present when the log has Config.entryKey set, see searchKeys.
+//
+// The sidecar is only a cache, if its missing or doesn't match the segment it's ignored
+// and regenerated from a scan of the segment.
+
+var indexFileMagic = []byte("RLIX")
+
+// indexFilename returns the name of the sidecar index file for a segment.
+func indexFilename(segmentFilename string) string {
+	return strings.TrimSuffix(segmentFilename, ".seg") + ".idx"
+}
+
+// sealed returns true if the segment has been finished and is named first-last.seg
+func (s *segmentReader) sealed() bool {
+	return strings.Contains(s.filename, "-")
+}
+
+// loadOffsets populates the segment's entry offsets if they aren't already loaded. For
+// sealed segments they're read from the sidecar index file, or if that's missing or
+// corrupt, the segment is scanned and the sidecar written for next time. Its safe for
+// concurrent readers to call loadOffsets.
+func (s *segmentReader) loadOffsets() error {
+	s.loadLock.Lock()
+	defer s.loadLock.Unlock()
+	if s.offsets != nil || s.blocks != nil {
+		return nil
+	}
+	if !s.sealed() {
+		return s.index()
+	}
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	offsets, keys, err := readIndexFile(path.Join(s.dir, indexFilename(s.filename)), info.Size())
+	if err == nil && Index(len(offsets)) == s.lastIndex-s.firstIndex+1 {
+		s.offsets = offsets
+		if keys != nil && s.keys == nil {
+			s.keys = keys
+		}
+		return nil
+	}
+	if err := s.index(); err != nil {
+		return err
+	}
+	// the sidecar is only an optimization, failing to write it shouldn't fail the read.
+	if !s.config.ReadOnly {
+		s.writeIndexFile(info.Size())
+	}
+	return nil
+}
+
+// writeIndexFile writes the sidecar index for a sealed segment whose file is size bytes long.
+func (s *segmentReader) writeIndexFile(size int64) error {
+	buf := make([]byte, 0, 4+2*binary.MaxVarintLen64+len(s.offsets)*2+8)
+	buf = append(buf, indexFileMagic...)
+	var scratch [binary.MaxVarintLen64]byte
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(len(s.offsets)))]...)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(size))]...)
+	prev := int64(0)
+	for _, o := range s.offsets {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(o-prev))]...)
+		prev = o
+	}
+	if s.keys != nil {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], s.keys.first)]...)
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], s.keys.last)]...)
+	}
+	h := fnv.New64a()
+	h.Write(buf)
+	binary.LittleEndian.PutUint64(scratch[:8], h.Sum64())
+	buf = append(buf, scratch[:8]...)
+	return ioutil.WriteFile(path.Join(s.dir, indexFilename(s.filename)), buf, 0644)
+}
+
+// removeIndexFile removes the segment's sidecar index file if there is one.
+func (s *segmentReader) removeIndexFile() error {
+	err := os.Remove(path.Join(s.dir, indexFilename(s.filename)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+var errBadIndexFile = errors.New("Segment index file is corrupt")
+
+// readIndexFile reads the offsets and keys, if present, from a sidecar index file, checking
+// that its valid for a segment file of segmentSize bytes.
+func readIndexFile(filename string, segmentSize int64) ([]int64, *keyRange, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < len(indexFileMagic)+8 || !bytes.HasPrefix(data, indexFileMagic) {
+		return nil, nil, errBadIndexFile
+	}
+	body := data[:len(data)-8]
+	h := fnv.New64a()
+	h.Write(body)
+	if h.Sum64() != binary.LittleEndian.Uint64(data[len(data)-8:]) {
+		return nil, nil, errBadIndexFile
+	}
+	r := bytes.NewReader(body[len(indexFileMagic):])
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(len(body)) {
+		return nil, nil, errBadIndexFile
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || int64(size) != segmentSize {
+		return nil, nil, errBadIndexFile
+	}
+	offsets := make([]int64, count)
+	prev := int64(0)
+	for i := range offsets {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, errBadIndexFile
+		}
+		prev += int64(delta)
+		offsets[i] = prev
+	}
+	if r.Len() == 0 {
+		return offsets, nil, nil
+	}
+	first, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, errBadIndexFile
+	}
+	last, err := binary.ReadUvarint(r)
+	if err != nil || r.Len() != 0 {
+		return nil, nil, errBadIndexFile
+	}
+	return offsets, &keyRange{first: first, last: last}, nil
+}
@@ -0,0 +1,104 @@
+package raftylog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_SegmentIndexFile(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	seg, err := newSegment(dir, &config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([][]byte, 50)
+	for i := range entries {
+		entries[i] = make([]byte, 1+i*7)
+		entries[i][0] = byte(i)
+	}
+	if _, _, err := appendEntries(seg, entries...); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.finish(); err != nil {
+		t.Fatal(err)
+	}
+	seg.reader.close()
+	segFile := fmt.Sprintf("%020d-%020d.seg", 1, 50)
+	idxFile := path.Join(dir, indexFilename(segFile))
+	if _, err := os.Stat(idxFile); err != nil {
+		t.Fatalf("finish should of written an index file, %v", err)
+	}
+
+	segr, err := openSegment(dir, segFile, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := segr.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(segr.offsets) != fmt.Sprint(seg.reader.offsets) {
+		t.Errorf("offsets loaded from index file %v don't match %v", segr.offsets, seg.reader.offsets)
+	}
+	read(t, segr, 30, entries[29])
+	segr.close()
+
+	// a corrupt index should be ignored & regenerated
+	data, err := ioutil.ReadFile(idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10]++
+	if err := ioutil.WriteFile(idxFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path.Join(dir, segFile))
+	if _, _, err := readIndexFile(idxFile, info.Size()); err != errBadIndexFile {
+		t.Errorf("Expecting corrupt index file to be detected, got %v", err)
+	}
+	segr, err = openSegment(dir, segFile, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, segr, 42, entries[41])
+	if _, _, err := readIndexFile(idxFile, info.Size()); err != nil {
+		t.Errorf("Index file should of been regenerated, %v", err)
+	}
+
+	// rewinding a sealed segment renames its index along with it
+	if err := segr.rewindTo(11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(idxFile); !os.IsNotExist(err) {
+		t.Errorf("Old index file should of been removed, %v", err)
+	}
+	newIdxFile := path.Join(dir, indexFilename(segr.filename))
+	offsets, _, err := readIndexFile(newIdxFile, segr.offsets[len(segr.offsets)-1]+int64(frameSize(currentSegmentVersion, len(entries[9]))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 10 {
+		t.Errorf("Rewound index has %d entries, expecting 10", len(offsets))
+	}
+
+	// a missing index should be regenerated
+	segr.close()
+	os.Remove(newIdxFile)
+	segr, err = openSegment(dir, segr.filename, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, segr, 10, entries[9])
+	if _, err := os.Stat(newIdxFile); err != nil {
+		t.Errorf("Missing index file should of been regenerated, %v", err)
+	}
+	if err := segr.delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(newIdxFile); !os.IsNotExist(err) {
+		t.Errorf("Deleting a segment should remove its index file, %v", err)
+	}
+}
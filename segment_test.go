@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
-var config = Config{0, 0}
+var config = Config{}
 
 func testDir(t *testing.T) (string, func()) {
-	dir, err := ioutil.TempDir("", t.Name())
+	dir, err := ioutil.TempDir("", strings.ReplaceAll(t.Name(), "/", "_"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +58,7 @@ func Test_Segment(t *testing.T) {
 	seg.reader.close()
 
 	files, err := os.ReadDir(dir)
-	segr, err := openSegment(dir, files[0].Name())
+	segr, err := openSegment(dir, files[0].Name(), &config)
 	if err != nil {
 		t.Fatalf("Failed to open existing segment %v", err)
 	}
@@ -84,14 +85,14 @@ func Test_NotFirstSegment(t *testing.T) {
 	}
 	data := make([]byte, 150)
 	for i := 511; i <= 613; i++ {
-		seg.append(data)
+		appendEntries(seg, data)
 	}
 	x, err := seg.reader.read(613)
 	if err != nil {
 		t.Fatal(err)
 	}
 	seg.finish()
-	segr, err := openSegment(dir, fmt.Sprintf("%020d-%020d.seg", 511, 613))
+	segr, err := openSegment(dir, fmt.Sprintf("%020d-%020d.seg", 511, 613), &config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -117,7 +118,7 @@ func Test_WriteReadWrite(t *testing.T) {
 		data1[i] = i
 		data2[i] = 200 - i
 	}
-	idx1, err := seg.append(data1)
+	idx1, _, err := appendEntries(seg, data1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,7 +126,7 @@ func Test_WriteReadWrite(t *testing.T) {
 	if !bytes.Equal(read1, data1) {
 		t.Fatalf("read1 wrong")
 	}
-	idx2, err := seg.append(data2)
+	idx2, _, err := appendEntries(seg, data2)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -152,13 +153,13 @@ func Test_SegmentRewind(t *testing.T) {
 		t.Errorf("Error creating segment %v", err)
 	}
 	for i := byte(0); i < 100; i++ {
-		_, err := seg.append([]byte{i, i, i, i, i, i, i, i, i, i, i, i, i})
+		_, _, err := appendEntries(seg, []byte{i, i, i, i, i, i, i, i, i, i, i, i, i})
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 	seg.rewindTo(Index(50))
-	idx, err := seg.append([]byte{255})
+	idx, _, err := appendEntries(seg, []byte{255})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,8 +187,7 @@ func Test_SegmentRewind(t *testing.T) {
 	seg.finish()
 	seg.reader.f.Close()
 
-	files, err := os.ReadDir(dir)
-	seg2, err := openSegment(dir, files[0].Name())
+	seg2, err := openSegment(dir, seg.reader.filename, &config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,12 +212,125 @@ func read(t *testing.T, s *segmentReader, idx Index, expected []byte) {
 	}
 }
 
+// appendEntries writes entries to the segment and publishes them, as Log.appendBatch does.
+// It returns the index of the first entry and the number of entries written.
+func appendEntries(s *segmentReaderWriter, entries ...[]byte) (Index, int, error) {
+	idx := s.nextIndex
+	offsets, fileSize, err := s.writeBatch(entries)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.publish(offsets, fileSize)
+	return idx, len(offsets), nil
+}
+
 func write(t *testing.T, s *segmentReaderWriter, data []byte, expectedIdx Index) {
-	idx, err := s.append(data)
+	idx, _, err := appendEntries(s, data)
 	if err != nil {
 		t.Errorf("Error writing to segment %v", err)
 	}
 	if idx != expectedIdx {
-		t.Errorf("Unexpected index %d returned from segment.append (should be %d)", idx, expectedIdx)
+		t.Errorf("Unexpected index %d returned from appendEntries (should be %d)", idx, expectedIdx)
+	}
+}
+
+func Test_SegmentAppendBatch(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	seg, err := newSegment(dir, &Config{MaxSegmentItems: 5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([][]byte, 8)
+	for i := range entries {
+		entries[i] = []byte{byte(i), byte(i)}
+	}
+	_, n, err := appendEntries(seg, entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("appendEntries wrote %d entries, expecting 5", n)
+	}
+	if !seg.full() {
+		t.Errorf("Segment should be full")
+	}
+	for i := 0; i < n; i++ {
+		read(t, &seg.reader, Index(i+1), entries[i])
+	}
+	seg.finish()
+	segr, err := openSegment(dir, fmt.Sprintf("%020d-%020d.seg", 1, 5), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		read(t, segr, Index(i+1), entries[i])
+	}
+}
+
+func Test_SegmentTornTail(t *testing.T) {
+	entries := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	cases := []struct {
+		name      string
+		damage    func(f *os.File, size int64) error
+		lastIndex Index
+	}{
+		{"partialLength", func(f *os.File, size int64) error {
+			_, err := f.WriteAt([]byte{10, 0}, size)
+			return err
+		}, 3},
+		{"partialEntry", func(f *os.File, size int64) error {
+			_, err := f.WriteAt([]byte{10, 0, 0, 0, 1, 2, 3}, size)
+			return err
+		}, 3},
+		{"missingHash", func(f *os.File, size int64) error {
+			return f.Truncate(size - 3)
+		}, 2},
+		{"badHash", func(f *os.File, size int64) error {
+			_, err := f.WriteAt([]byte{42}, size-10)
+			return err
+		}, 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			seg, err := newSegment(dir, &config, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := appendEntries(seg, entries...); err != nil {
+				t.Fatal(err)
+			}
+			goodSize := seg.fileSize
+			if err := tc.damage(seg.reader.f, seg.fileSize); err != nil {
+				t.Fatal(err)
+			}
+			seg.reader.close()
+
+			segr, err := openSegment(dir, seg.reader.filename, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if segr.lastIndex != tc.lastIndex {
+				t.Errorf("Unexpected lastIndex %d after repair, expecting %d", segr.lastIndex, tc.lastIndex)
+			}
+			if segr.repair == nil {
+				t.Fatalf("Expecting a repair to be reported")
+			}
+			if segr.repair.LastIndex != tc.lastIndex {
+				t.Errorf("Repair reported lastIndex %d, expecting %d", segr.repair.LastIndex, tc.lastIndex)
+			}
+			info, err := segr.f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != segr.repair.Offset || (tc.lastIndex == 3 && info.Size() != goodSize) {
+				t.Errorf("Segment has unexpected size %d after repair %+v", info.Size(), segr.repair)
+			}
+			for i := Index(1); i <= tc.lastIndex; i++ {
+				read(t, segr, i, entries[i-1])
+			}
+		})
 	}
 }
@@ -0,0 +1,333 @@
+package raftylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Snapshots are stored in the snapshots sub-directory of the log directory, each one
+// in its own directory named after the snapshot's id, containing
+//	meta.json   the raft.SnapshotMeta along with the CRC-32C of the state
+//	state.bin   the snapshot data written by the FSM
+// A snapshot is written to a directory with a .tmp suffix, which is renamed once the
+// snapshot is complete and synced to disk. Any .tmp directories left from a crash are
+// removed when the store is opened.
+
+const (
+	snapshotsDirname     = "snapshots"
+	snapshotMetaFilename = "meta.json"
+	snapshotDataFilename = "state.bin"
+	snapshotTmpSuffix    = ".tmp"
+)
+
+var _ raft.SnapshotStore = (*SnapshotStore)(nil)
+
+// SnapshotStore is a raft.SnapshotStore that keeps snapshots in files alongside the log.
+type SnapshotStore struct {
+	dir    string // the snapshots directory
+	retain int
+
+	// OnSkippedSnapshot if set is called for each snapshot directory that's ignored because
+	// its metadata can't be read.
+	OnSkippedSnapshot func(id string, err error)
+}
+
+// snapshotMeta is what's stored in a snapshot's meta.json file.
+type snapshotMeta struct {
+	raft.SnapshotMeta
+	CRC uint32
+}
+
+// NewSnapshotStore opens the snapshot store for the log in dir, retain is the number of
+// the most recent snapshots to keep, it must be at least 1.
+func NewSnapshotStore(dir string, retain int) (*SnapshotStore, error) {
+	if retain < 1 {
+		return nil, errors.New("Must retain at least 1 snapshot")
+	}
+	s := &SnapshotStore{dir: path.Join(dir, snapshotsDirname), retain: retain}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if d.IsDir() && strings.HasSuffix(d.Name(), snapshotTmpSuffix) {
+			if err := os.RemoveAll(path.Join(s.dir, d.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Create starts a new snapshot, the snapshot isn't visible to List or Open until the returned sink is closed.
+func (s *SnapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+
+	if version < raft.SnapshotVersionMin || version > raft.SnapshotVersionMax {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixNano()/int64(time.Millisecond))
+	tmpDir := path.Join(s.dir, id+snapshotTmpSuffix)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path.Join(tmpDir, snapshotDataFilename))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	crc := crc32.New(castagnoli)
+	sink := &snapshotSink{
+		store:  s,
+		dir:    tmpDir,
+		f:      f,
+		crc:    crc,
+		buffer: bufio.NewWriter(io.MultiWriter(f, crc)),
+		meta: snapshotMeta{SnapshotMeta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 id,
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		}},
+	}
+	return sink, nil
+}
+
+// List returns the available snapshots, newest first.
+func (s *SnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*raft.SnapshotMeta, len(metas))
+	for i := range metas {
+		res[i] = &metas[i].SnapshotMeta
+	}
+	return res, nil
+}
+
+// list returns all the complete snapshots, newest first.
+func (s *SnapshotStore) list() ([]*snapshotMeta, error) {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*snapshotMeta, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasSuffix(d.Name(), snapshotTmpSuffix) {
+			continue
+		}
+		meta, err := s.readMeta(d.Name())
+		if err != nil {
+			if s.OnSkippedSnapshot != nil {
+				s.OnSkippedSnapshot(d.Name(), err)
+			}
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(a, b int) bool {
+		ma, mb := metas[a], metas[b]
+		if ma.Term != mb.Term {
+			return ma.Term > mb.Term
+		}
+		if ma.Index != mb.Index {
+			return ma.Index > mb.Index
+		}
+		return ma.ID > mb.ID
+	})
+	return metas, nil
+}
+
+func (s *SnapshotStore) readMeta(id string) (*snapshotMeta, error) {
+	data, err := ioutil.ReadFile(path.Join(s.dir, id, snapshotMetaFilename))
+	if err != nil {
+		return nil, err
+	}
+	meta := &snapshotMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Open returns the snapshot with the given id, its contents are checked against the
+// CRC recorded when it was written before its returned.
+func (s *SnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path.Join(s.dir, id, snapshotDataFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.New(castagnoli)
+	size, err := io.Copy(crc, f)
+	if err == nil && (size != meta.Size || crc.Sum32() != meta.CRC) {
+		err = fmt.Errorf("Snapshot %v is corrupt, has size %d crc %x expecting size %d crc %x", id, size, crc.Sum32(), meta.Size, meta.CRC)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &snapshotReader{bufio.NewReader(f), f}, nil
+}
+
+// TrimLog deletes entries from the start of log that are covered by the most recent
+// snapshot, keeping the trailing entries up to and including the snapshot's index. It
+// returns the log's new first index. Nothing is deleted if there's no snapshot.
+func (s *SnapshotStore) TrimLog(log *Log, trailing uint64) (Index, error) {
+	metas, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	if len(metas) == 0 || metas[0].Index < trailing {
+		return log.FirstIndex(), nil
+	}
+	to := Index(metas[0].Index - trailing + 1)
+	// DeleteTo won't delete the entire log
+	last := log.LastIndex()
+	if last <= 1 {
+		return log.FirstIndex(), nil
+	}
+	if to >= last {
+		to = last - 1
+	}
+	if to <= log.FirstIndex() {
+		return log.FirstIndex(), nil
+	}
+	if err := log.DeleteTo(to); err != nil {
+		return 0, err
+	}
+	return log.FirstIndex(), nil
+}
+
+// reap removes all but the most recent retain snapshots.
+func (s *SnapshotStore) reap() error {
+	metas, err := s.list()
+	if err != nil {
+		return err
+	}
+	for i := s.retain; i < len(metas); i++ {
+		if err := os.RemoveAll(path.Join(s.dir, metas[i].ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type snapshotSink struct {
+	store  *SnapshotStore
+	dir    string
+	f      *os.File
+	crc    hash.Hash32
+	buffer *bufio.Writer
+	meta   snapshotMeta
+	closed bool
+}
+
+func (s *snapshotSink) ID() string {
+	return s.meta.ID
+}
+
+func (s *snapshotSink) Write(b []byte) (int, error) {
+	n, err := s.buffer.Write(b)
+	s.meta.Size += int64(n)
+	return n, err
+}
+
+// Close completes the snapshot, its synced to disk before being made visible.
+func (s *snapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.finish(); err != nil {
+		os.RemoveAll(s.dir)
+		return err
+	}
+	final := strings.TrimSuffix(s.dir, snapshotTmpSuffix)
+	if err := os.Rename(s.dir, final); err != nil {
+		os.RemoveAll(s.dir)
+		return err
+	}
+	if err := syncDir(s.store.dir); err != nil {
+		return err
+	}
+	return s.store.reap()
+}
+
+// finish flushes & syncs the snapshot data and writes its metadata.
+func (s *snapshotSink) finish() error {
+	err := s.buffer.Flush()
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err2 := s.f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	s.meta.CRC = s.crc.Sum32()
+	data, err := json.Marshal(&s.meta)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path.Join(s.dir, snapshotMetaFilename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	return err
+}
+
+// Cancel abandons the snapshot.
+func (s *snapshotSink) Cancel() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.f.Close()
+	return os.RemoveAll(s.dir)
+}
+
+type snapshotReader struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (r *snapshotReader) Close() error {
+	return r.f.Close()
+}
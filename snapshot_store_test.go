@@ -0,0 +1,173 @@
+package raftylog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func createSnapshot(t *testing.T, s *SnapshotStore, index, term uint64, data []byte) string {
+	conf := raft.Configuration{Servers: []raft.Server{{Suffrage: raft.Voter, ID: "n1", Address: "localhost:1"}}}
+	sink, err := s.Create(raft.SnapshotVersionMax, index, term, conf, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sink.ID()
+}
+
+func Test_SnapshotStore(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	s, err := NewSnapshotStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.List(); err != nil || len(list) != 0 {
+		t.Errorf("Expecting empty list, got %v %v", list, err)
+	}
+	id1 := createSnapshot(t, s, 10, 1, []byte("first"))
+	id2 := createSnapshot(t, s, 20, 2, []byte("second"))
+
+	// a cancelled snapshot shouldn't show up
+	sink, err := s.Create(raft.SnapshotVersionMax, 25, 2, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write([]byte("cancelled"))
+	if err := sink.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != id2 || list[1].ID != id1 {
+		t.Fatalf("Unexpected snapshots listed %+v", list)
+	}
+	if list[0].Index != 20 || list[0].Term != 2 || list[0].Size != 6 || len(list[0].Configuration.Servers) != 1 {
+		t.Errorf("Unexpected snapshot metadata %+v", list[0])
+	}
+	meta, rc, err := s.Open(id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, []byte("second")) || meta.ID != id2 {
+		t.Errorf("Unexpected snapshot contents %q %v %+v", data, err, meta)
+	}
+
+	// retention removes the oldest
+	id3 := createSnapshot(t, s, 30, 3, []byte("third"))
+	list, err = s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != id3 || list[1].ID != id2 {
+		t.Errorf("Unexpected snapshots listed after retention %+v", list)
+	}
+	if _, _, err := s.Open(id1); err == nil {
+		t.Errorf("Oldest snapshot should of been removed")
+	}
+
+	// corruption is detected on open
+	fn := path.Join(dir, snapshotsDirname, id3, snapshotDataFilename)
+	if err := ioutil.WriteFile(fn, []byte("thirD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open(id3); err == nil {
+		t.Errorf("Open of corrupt snapshot should fail")
+	}
+
+	// snapshots without readable metadata are skipped
+	var skipped []string
+	s.OnSkippedSnapshot = func(id string, err error) {
+		skipped = append(skipped, id)
+	}
+	if err := os.Mkdir(path.Join(dir, snapshotsDirname, "1-2-3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if snaps, err := s.List(); err != nil || len(snaps) != 2 {
+		t.Errorf("Unexpected snapshots %v %v", snaps, err)
+	}
+	if len(skipped) != 1 || skipped[0] != "1-2-3" {
+		t.Errorf("Unexpected skipped snapshots %v", skipped)
+	}
+
+	// leftover temp dirs are cleaned up
+	tmp := path.Join(dir, snapshotsDirname, "1-1-1"+snapshotTmpSuffix)
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSnapshotStore(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Temp snapshot dir should of been removed, %v", err)
+	}
+}
+
+func Test_SnapshotStoreTrimLog(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := OpenLog(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	s, err := NewSnapshotStore(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 100; i++ {
+		if err := log.StoreLog(&raft.Log{Index: i, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.CompactTo(s, 5); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := log.FirstIndex(); first != 1 {
+		t.Errorf("CompactTo without a snapshot shouldn't delete anything, FirstIndex is %d", first)
+	}
+	// an empty log, e.g. a follower that was just sent a snapshot, has nothing to trim
+	empty, err := Open(t.TempDir(), &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	createSnapshot(t, s, 55, 1, []byte("state"))
+	if first, err := s.TrimLog(empty, 5); err != nil || first != 0 {
+		t.Errorf("TrimLog of an empty log returned %d %v", first, err)
+	}
+	if err := log.CompactTo(s, 5); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := log.FirstIndex()
+	if first > 51 || first <= 1 {
+		t.Errorf("Unexpected FirstIndex %d after CompactTo", first)
+	}
+	// the log should always keep at least one entry
+	createSnapshot(t, s, 200, 1, []byte("state"))
+	if _, err := s.TrimLog(log.log, 0); err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := log.LastIndex(); last != 100 {
+		t.Errorf("Unexpected LastIndex %d", last)
+	}
+	// and the log directory should still open
+	if _, err := os.Stat(path.Join(dir, snapshotsDirname)); err != nil {
+		t.Fatal(err)
+	}
+}
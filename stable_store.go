@@ -0,0 +1,188 @@
+package raftylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// The stable store file format is
+//	magic     "RLSS"
+//	count     uvarint number of keys
+//	entries   count of: uvarint key length, key, uvarint value length, value
+//	crc       uint32 CRC-32C of all the preceding bytes
+// Every change rewrites the whole file, by writing a temp file, fsyncing it and then
+// renaming it over the previous version, so its always either the old or new state.
+
+const stableStoreFilename = "stable.dat"
+
+var stableStoreMagic = []byte("RLSS")
+
+// ErrKeyNotFound is returned by StableStore's Get & GetUint64 for keys that have never
+// been set. The raft library checks for this by its message, so it matches raft-boltdb's.
+var ErrKeyNotFound = errors.New("not found")
+
+var _ raft.StableStore = (*StableStore)(nil)
+
+// StableStore is a raft.StableStore that stores its keys & values in a single small,
+// crash safe file. Its intended for the handful of keys raft needs (CurrentTerm,
+// LastVoteTerm, LastVoteCand) and holds everything in memory.
+type StableStore struct {
+	filename string
+	lock     sync.RWMutex
+	values   map[string][]byte
+}
+
+// OpenStableStore opens the stable store in dir, creating it if needed.
+func OpenStableStore(dir string) (*StableStore, error) {
+	s := &StableStore{filename: path.Join(dir, stableStoreFilename)}
+	// a leftover temp file is from a write that never completed.
+	if err := removeAtomicTemp(s.filename); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		s.values = make(map[string][]byte)
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.values, err = unmarshalStableStore(data); err != nil {
+		return nil, fmt.Errorf("Stable store %v is corrupt: %v", s.filename, err)
+	}
+	return s, nil
+}
+
+// OpenStores opens the raft log and stable store kept in dir.
+func OpenStores(dir string, cfg *Config, createIfNeeded bool) (*RaftLog, *StableStore, error) {
+	log, err := OpenLog(dir, cfg, createIfNeeded)
+	if err != nil {
+		return nil, nil, err
+	}
+	stable, err := OpenStableStore(dir)
+	if err != nil {
+		log.Close()
+		return nil, nil, err
+	}
+	return log, stable, nil
+}
+
+func (s *StableStore) Set(key []byte, val []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := make(map[string][]byte, len(s.values)+1)
+	for k, v := range s.values {
+		values[k] = v
+	}
+	values[string(key)] = append([]byte(nil), val...)
+	if err := s.write(values); err != nil {
+		return err
+	}
+	s.values = values
+	return nil
+}
+
+// Get returns the value for key, or ErrKeyNotFound if key was never set.
+func (s *StableStore) Get(key []byte) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, exists := s.values[string(key)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *StableStore) SetUint64(key []byte, val uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+	return s.Set(key, b[:])
+}
+
+// GetUint64 returns the value for key, or ErrKeyNotFound if key was never set.
+func (s *StableStore) GetUint64(key []byte) (uint64, error) {
+	v, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("Value for key %q isn't a uint64", key)
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// write atomically replaces the store's file with one containing values.
+func (s *StableStore) write(values map[string][]byte) error {
+	return writeFileAtomic(s.filename, marshalStableStore(values))
+}
+
+func marshalStableStore(values map[string][]byte) []byte {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := append([]byte(nil), stableStoreMagic...)
+	var scratch [binary.MaxVarintLen64]byte
+	b = append(b, scratch[:binary.PutUvarint(scratch[:], uint64(len(keys)))]...)
+	for _, k := range keys {
+		b = append(b, scratch[:binary.PutUvarint(scratch[:], uint64(len(k)))]...)
+		b = append(b, k...)
+		b = append(b, scratch[:binary.PutUvarint(scratch[:], uint64(len(values[k])))]...)
+		b = append(b, values[k]...)
+	}
+	binary.LittleEndian.PutUint32(scratch[:], crc32.Checksum(b, castagnoli))
+	return append(b, scratch[:4]...)
+}
+
+var errBadStableStore = errors.New("invalid stable store data")
+
+func unmarshalStableStore(data []byte) (map[string][]byte, error) {
+	if len(data) < len(stableStoreMagic)+4 || !bytes.HasPrefix(data, stableStoreMagic) {
+		return nil, errBadStableStore
+	}
+	body := data[:len(data)-4]
+	if crc := binary.LittleEndian.Uint32(data[len(data)-4:]); crc != crc32.Checksum(body, castagnoli) {
+		return nil, fmt.Errorf("invalid crc %x", crc)
+	}
+	r := bytes.NewReader(body[len(stableStoreMagic):])
+	readBytes := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return nil, errBadStableStore
+		}
+		b := make([]byte, l)
+		r.Read(b)
+		return b, nil
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, errBadStableStore
+	}
+	values := make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		v, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		values[string(k)] = v
+	}
+	if r.Len() != 0 {
+		return nil, errBadStableStore
+	}
+	return values, nil
+}
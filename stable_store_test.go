@@ -0,0 +1,106 @@
+package raftylog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func Test_StableStore(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	s, err := OpenStableStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get([]byte("missing")); err == nil || err.Error() != "not found" {
+		t.Errorf("Get of missing key should return a not found error, but got %v", err)
+	}
+	if _, err := s.GetUint64([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("GetUint64 of missing key should return ErrKeyNotFound, but got %v", err)
+	}
+	if err := s.Set([]byte("LastVoteCand"), []byte("node-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 43); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+	check := func(s *StableStore) {
+		if v, err := s.Get([]byte("LastVoteCand")); err != nil || !bytes.Equal(v, []byte("node-1")) {
+			t.Errorf("Unexpected value %q %v", v, err)
+		}
+		if v, err := s.GetUint64([]byte("CurrentTerm")); err != nil || v != 43 {
+			t.Errorf("Unexpected value %d %v", v, err)
+		}
+		if v, err := s.Get([]byte("empty")); err != nil || len(v) != 0 {
+			t.Errorf("Unexpected value %q %v", v, err)
+		}
+	}
+	check(s)
+	// reopen with a leftover temp file from an incomplete write
+	if err := ioutil.WriteFile(atomicTempFilename(s.filename), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := OpenStableStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s2)
+	if _, err := os.Stat(atomicTempFilename(s.filename)); !os.IsNotExist(err) {
+		t.Errorf("Temp file should of been removed %v", err)
+	}
+	// corruption should be detected
+	fn := path.Join(dir, stableStoreFilename)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2]++
+	if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStableStore(dir); err == nil {
+		t.Errorf("Opening corrupt stable store should fail")
+	}
+}
+
+func Test_OpenStores(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, stable, err := OpenStores(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ raft.LogStore = log
+	var _ raft.StableStore = stable
+	if err := stable.SetUint64([]byte("CurrentTerm"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.StoreLog(&raft.Log{Index: 1, Term: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log, stable, err = OpenStores(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if v, err := stable.GetUint64([]byte("CurrentTerm")); err != nil || v != 5 {
+		t.Errorf("Unexpected value %d %v", v, err)
+	}
+	if has, err := raft.HasExistingState(log, stable, raft.NewInmemSnapshotStore()); err != nil || !has {
+		t.Errorf("HasExistingState returned %t %v", has, err)
+	}
+}
@@ -0,0 +1,187 @@
+package raftylog
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSubscriberOvertaken ends a subscription when DeleteTo removed entries before the
+// subscriber read them.
+var ErrSubscriberOvertaken = errors.New("Entries were deleted before the subscriber read them")
+
+// subscriptionBuffer is the number of entries buffered in a subscription's channel.
+const subscriptionBuffer = 64
+
+// Entry is sent to subscribers for each entry appended to the log.
+type Entry struct {
+	Index Index
+	Data  []byte
+	// Rewound is set when RewindTo removed entries the subscriber had already been sent.
+	// Entries from Index on should be discarded, the subscription continues from Index
+	// once new entries are appended.
+	Rewound bool
+	// Err is set on the last Entry sent before the subscription's channel is closed, it's
+	// ErrSubscriberOvertaken, ErrLogClosed or an error reading the log.
+	Err error
+}
+
+// subscription is the log's view of a subscriber, its fields are protected by the log's lock.
+type subscription struct {
+	next   Index // the index after the last entry the subscriber has read, or is reading
+	rewind Index // the lowest index RewindTo has rewound to since the subscriber last checked, 0 if none
+	done   chan struct{}
+}
+
+// waitChannel returns a channel that's closed the next time entries are appended or removed,
+// or the log is closed. The caller should hold lock for writing.
+func (log *Log) waitChannel() <-chan struct{} {
+	if log.notify == nil {
+		log.notify = make(chan struct{})
+	}
+	return log.notify
+}
+
+// broadcast wakes anyone waiting for the log to change, the caller should hold lock for writing.
+func (log *Log) broadcast() {
+	if log.notify != nil {
+		close(log.notify)
+		log.notify = nil
+	}
+}
+
+// rewound tells subscribers that have read past idx that RewindTo removed the entries from
+// idx on, the caller should hold lock for writing.
+func (log *Log) rewound(idx Index) {
+	for sub := range log.subs {
+		if idx < sub.next && (sub.rewind == 0 || idx < sub.rewind) {
+			sub.rewind = idx
+		}
+	}
+	log.broadcast()
+}
+
+// WaitFor blocks until the entry at idx has been appended, ctx is done, or the log is closed.
+// Entries are visible as soon as they're written, which may be before they're synced.
+func (log *Log) WaitFor(ctx context.Context, idx Index) error {
+	for {
+		log.lock.Lock()
+		if log.closed {
+			log.lock.Unlock()
+			return ErrLogClosed
+		}
+		if log.lastIndex() >= idx {
+			log.lock.Unlock()
+			return nil
+		}
+		wait := log.waitChannel()
+		log.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// Subscribe sends each entry from the index from onwards to the returned channel, including
+// entries appended after Subscribe is called. The subscription continues until cancel is
+// called or an error occurs, after which the channel is closed. A subscriber that falls so
+// far behind that DeleteTo removes entries it hasn't read is sent ErrSubscriberOvertaken.
+// If RewindTo removes entries the subscriber has been sent, it's sent an Entry with Rewound
+// set before any replacement entries.
+func (log *Log) Subscribe(from Index) (<-chan Entry, func()) {
+	sub := &subscription{next: from, done: make(chan struct{})}
+	ch := make(chan Entry, subscriptionBuffer)
+	log.lock.Lock()
+	if log.subs == nil {
+		log.subs = make(map[*subscription]struct{})
+	}
+	log.subs[sub] = struct{}{}
+	log.lock.Unlock()
+	go log.follow(sub, from, ch)
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { close(sub.done) })
+	}
+}
+
+// follow sends entries to a subscriber until its cancelled or an error occurs.
+func (log *Log) follow(sub *subscription, next Index, ch chan<- Entry) {
+	defer close(ch)
+	defer func() {
+		log.lock.Lock()
+		delete(log.subs, sub)
+		log.lock.Unlock()
+	}()
+	send := func(e Entry) bool {
+		select {
+		case ch <- e:
+			return true
+		case <-sub.done:
+			return false
+		}
+	}
+	sent := Index(0) // the last index sent to the subscriber
+	for {
+		log.lock.Lock()
+		if rewind := sub.rewind; rewind != 0 {
+			sub.rewind = 0
+			log.lock.Unlock()
+			if rewind <= sent {
+				if !send(Entry{Index: rewind, Rewound: true}) {
+					return
+				}
+				sent = rewind - 1
+			}
+			if rewind < next {
+				next = rewind
+			}
+			continue
+		}
+		if log.closed {
+			log.lock.Unlock()
+			send(Entry{Index: next, Err: ErrLogClosed})
+			return
+		}
+		if next < log.firstIndex() {
+			log.lock.Unlock()
+			send(Entry{Index: next, Err: ErrSubscriberOvertaken})
+			return
+		}
+		last := log.lastIndex()
+		if next > last {
+			wait := log.waitChannel()
+			sub.next = next
+			log.lock.Unlock()
+			select {
+			case <-wait:
+			case <-sub.done:
+				return
+			}
+			continue
+		}
+		// claim the entries up to last, so that a rewind while they're being read is reported.
+		sub.next = last + 1
+		log.lock.Unlock()
+		it := log.Iterator(next, last)
+		for it.Next() {
+			if !send(Entry{Index: it.Index(), Data: it.Value()}) {
+				return
+			}
+			sent = it.Index()
+			next = sent + 1
+		}
+		if err := it.Err(); err != nil {
+			// entries being removed while they're read is dealt with above, any other error
+			// ends the subscription.
+			log.lock.RLock()
+			removed := sub.rewind != 0 || next < log.firstIndex() || log.closed
+			log.lock.RUnlock()
+			if !removed {
+				send(Entry{Index: next, Err: err})
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package raftylog
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan Entry) Entry {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("Subscription channel closed unexpectedly")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for subscription")
+	}
+	return Entry{}
+}
+
+func receiveEntries(t *testing.T, ch <-chan Entry, from, to Index, entries [][]byte) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		e := receive(t, ch)
+		if e.Err != nil || e.Rewound || e.Index != i || !bytes.Equal(e.Data, entries[i-1]) {
+			t.Fatalf("Unexpected entry %+v, expecting %d", e, i)
+		}
+	}
+}
+
+func Test_LogSubscribe(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(40)
+	if _, _, err := log.AppendBatch(entries[:5]); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel := log.Subscribe(3)
+	receiveEntries(t, ch, 3, 5, entries)
+	for i := 5; i < 25; i++ {
+		if _, err := log.Append(entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiveEntries(t, ch, 6, 25, entries)
+
+	// rewinding past what's been sent is reported before the replacement entries
+	if err := log.RewindTo(20); err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries[:19], []byte("twenty"), []byte("twenty one"))
+	if _, _, err := log.AppendBatch(entries[19:]); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, ch); !e.Rewound || e.Index != 20 {
+		t.Fatalf("Expecting rewind to 20, got %+v", e)
+	}
+	receiveEntries(t, ch, 20, 21, entries)
+
+	cancel()
+	cancel()
+	for range ch {
+	}
+	log.lock.RLock()
+	subs := len(log.subs)
+	log.lock.RUnlock()
+	if subs != 0 {
+		t.Errorf("Expecting cancelled subscription to be removed, got %d", subs)
+	}
+}
+
+func Test_LogSubscribeOvertaken(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{MaxSegmentItems: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	entries := testEntries(30)
+	if _, _, err := log.AppendBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.DeleteTo(21); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := log.Subscribe(5)
+	if e := receive(t, ch); e.Err != ErrSubscriberOvertaken {
+		t.Errorf("Expecting ErrSubscriberOvertaken, got %+v", e)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("Expecting channel to be closed")
+	}
+
+	ch, _ = log.Subscribe(31)
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, ch); e.Err != ErrLogClosed {
+		t.Errorf("Expecting ErrLogClosed, got %+v", e)
+	}
+}
+
+func Test_LogWaitFor(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if _, err := log.Append([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.WaitFor(context.Background(), 1); err != nil {
+		t.Errorf("Waiting for an existing entry should return immediately, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := log.WaitFor(ctx, 2); err != context.DeadlineExceeded {
+		t.Errorf("Expecting deadline exceeded, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- log.WaitFor(context.Background(), 3)
+	}()
+	if _, _, err := log.AppendBatch([][]byte{[]byte("two"), []byte("three")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error waiting for append %v", err)
+	}
+
+	go func() {
+		done <- log.WaitFor(context.Background(), 4)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	log.Close()
+	if err := <-done; err != ErrLogClosed {
+		t.Errorf("Expecting ErrLogClosed, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package raftylog
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// SyncPolicy controls when appended entries are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncEveryAppend fsyncs the active segment before Append returns. This is the default.
+	SyncEveryAppend SyncPolicy = iota
+	// SyncPeriodic fsyncs the active segment once Config.SyncEntries entries have been
+	// appended, or once the oldest unsynced entry is older than Config.SyncInterval,
+	// whichever comes first. If no more entries are appended, a timer syncs them once
+	// SyncInterval has passed.
+	SyncPeriodic
+	// SyncNever leaves flushing to the OS. Entries can be lost on a power failure.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncEveryAppend:
+		return "SyncEveryAppend"
+	case SyncPeriodic:
+		return "SyncPeriodic"
+	case SyncNever:
+		return "SyncNever"
+	}
+	return "SyncPolicy(?)"
+}
+
+// syncState tracks entries that have been written but not yet fsync'd.
+type syncState struct {
+	unsynced int
+	since    time.Time
+	timer    *time.Timer // syncs the entries once SyncInterval has passed, see Log.syncLater
+	pending  bool        // true if timer is running
+	err      error       // from a sync run by timer, returned by the next Append or Sync
+}
+
+// due records that n more entries were written and returns true if the
+// policy says they should be fsync'd now.
+func (s *syncState) due(config *Config, n int) bool {
+	if s.unsynced == 0 {
+		s.since = time.Now()
+	}
+	s.unsynced += n
+	switch config.Sync {
+	case SyncEveryAppend:
+		return true
+	case SyncPeriodic:
+		if config.SyncEntries > 0 && s.unsynced >= config.SyncEntries {
+			return true
+		}
+		if config.SyncInterval > 0 && time.Since(s.since) >= config.SyncInterval {
+			return true
+		}
+		return config.SyncEntries <= 0 && config.SyncInterval <= 0
+	}
+	return false
+}
+
+func (s *syncState) reset() {
+	s.unsynced = 0
+}
+
+// wait returns how long until the unsynced entries are older than SyncInterval, and
+// false if there's nothing for a timer to do.
+func (s *syncState) wait(config *Config) (time.Duration, bool) {
+	if config.Sync != SyncPeriodic || config.SyncInterval <= 0 || s.unsynced == 0 {
+		return 0, false
+	}
+	return config.SyncInterval - time.Since(s.since), true
+}
+
+// syncDir fsyncs a directory so that file creates, renames & removes in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return any(err, d.Close())
+}
+
+// atomicTempFilename is the temp file writeFileAtomic uses to replace fn.
+func atomicTempFilename(fn string) string {
+	return fn + ".tmp"
+}
+
+// removeAtomicTemp removes the temp file left behind by a writeFileAtomic of fn that
+// never completed, if there is one.
+func removeAtomicTemp(fn string) error {
+	if err := os.Remove(atomicTempFilename(fn)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file fn with data via a synced temp file & rename.
+func writeFileAtomic(fn string, data []byte) error {
+	tmp := atomicTempFilename(fn)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(path.Dir(fn))
+}
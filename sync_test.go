@@ -0,0 +1,128 @@
+package raftylog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_SyncStateDue(t *testing.T) {
+	type step struct {
+		n   int
+		due bool
+	}
+	cases := []struct {
+		name  string
+		cfg   Config
+		steps []step
+	}{
+		{"everyAppend", Config{}, []step{{1, true}, {1, true}, {5, true}}},
+		{"never", Config{Sync: SyncNever}, []step{{1, false}, {100, false}}},
+		{"entries", Config{Sync: SyncPeriodic, SyncEntries: 3}, []step{{1, false}, {1, false}, {1, true}}},
+		{"batchOverEntries", Config{Sync: SyncPeriodic, SyncEntries: 3}, []step{{4, true}}},
+		{"noThresholds", Config{Sync: SyncPeriodic}, []step{{1, true}}},
+		{"longInterval", Config{Sync: SyncPeriodic, SyncInterval: time.Hour}, []step{{1, false}, {50, false}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := syncState{}
+			for i, st := range tc.steps {
+				if act := s.due(&tc.cfg, st.n); act != st.due {
+					t.Errorf("step %d: due returned %t expecting %t", i, act, st.due)
+				}
+				if st.due {
+					s.reset()
+				}
+			}
+		})
+	}
+	s := syncState{}
+	cfg := Config{Sync: SyncPeriodic, SyncInterval: time.Millisecond}
+	if s.due(&cfg, 1) {
+		t.Errorf("first entry shouldn't be due yet")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !s.due(&cfg, 1) {
+		t.Errorf("entries older than SyncInterval should be due")
+	}
+}
+
+func Test_LogSyncPolicies(t *testing.T) {
+	policies := []Config{
+		{MaxSegmentItems: 3, Sync: SyncEveryAppend},
+		{MaxSegmentItems: 3, Sync: SyncPeriodic, SyncEntries: 2},
+		{MaxSegmentItems: 3, Sync: SyncNever},
+	}
+	for _, cfg := range policies {
+		t.Run(cfg.Sync.String(), func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			log, err := Open(dir, &cfg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := byte(0); i < 10; i++ {
+				if _, err := log.Append([]byte{i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := log.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if log.sync.unsynced != 0 {
+				t.Errorf("Sync should reset the unsynced count, but was %d", log.sync.unsynced)
+			}
+			if err := log.RewindTo(8); err != nil {
+				t.Fatal(err)
+			}
+			if err := log.DeleteTo(4); err != nil {
+				t.Fatal(err)
+			}
+			if err := log.Close(); err != nil {
+				t.Fatal(err)
+			}
+			log, err = Open(dir, &cfg, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			if log.FirstIndex() != 4 || log.LastIndex() != 7 {
+				t.Errorf("Log has unexpected range %d-%d", log.FirstIndex(), log.LastIndex())
+			}
+			for i := log.FirstIndex(); i <= log.LastIndex(); i++ {
+				d, err := log.Read(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(d, []byte{byte(i - 1)}) {
+					t.Errorf("Unexpected data %v for index %d", d, i)
+				}
+			}
+		})
+	}
+}
+
+func Test_LogSyncInterval(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	log, err := Open(dir, &Config{Sync: SyncPeriodic, SyncEntries: 100, SyncInterval: 50 * time.Millisecond}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	unsynced := func() int {
+		log.appendLock.Lock()
+		defer log.appendLock.Unlock()
+		return log.sync.unsynced
+	}
+	for i := byte(0); i < 2; i++ {
+		if _, err := log.Append([]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+		if unsynced() == 0 {
+			t.Fatalf("Append shouldn't sync before SyncInterval has passed")
+		}
+		// without another append, the timer should sync the entries.
+		waitFor(t, func() bool { return unsynced() == 0 })
+	}
+}
@@ -0,0 +1,355 @@
+package raftylog
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// verifyCheckInterval is how many entries are verified between checks of the context.
+const verifyCheckInterval = 1024
+
+// VerifyOptions controls what Verify & VerifyDir check.
+type VerifyOptions struct {
+	// Decode decrypts & decompresses every entry as well as checking its hash. The hash
+	// covers the stored data, so encrypted segments can be verified without their keys
+	// unless Decode is set.
+	Decode bool
+	// Keys are used to decrypt entries when Decode is set, Log.Verify defaults to the
+	// log's Config.Keys.
+	Keys KeyProvider
+}
+
+// VerifyReport is the result of verifying a log.
+type VerifyReport struct {
+	Segments []SegmentReport // in index order
+	Gaps     []SegmentGap    // places where the segments aren't contiguous
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	for i := range r.Segments {
+		if !r.Segments[i].OK() {
+			return false
+		}
+	}
+	return len(r.Gaps) == 0
+}
+
+// SegmentReport is the result of verifying one segment.
+type SegmentReport struct {
+	Segment    string
+	FirstIndex Index
+	// LastIndex is from the filename of a sealed segment, or the last complete entry of
+	// an unfinished segment.
+	LastIndex Index
+	Size      int64
+	// BadIndex is the first index that failed verification, 0 if the problem isn't with a
+	// particular entry. Entries after it weren't checked.
+	BadIndex Index
+	// Err is what was wrong with the segment, nil if it verified.
+	Err error
+	// BadSidecar is set if the segment's sidecar index file has the wrong offsets.
+	BadSidecar bool
+
+	goodSize int64 // size of a regular segment up to the end of its last good entry, see Repair
+}
+
+// OK returns true if no problems were found with the segment.
+func (r *SegmentReport) OK() bool {
+	return r.Err == nil && !r.BadSidecar
+}
+
+// Verify checks every entry in the log: each segment's header is validated, its entries'
+// hashes are recomputed, the entry count is compared with the segment's filename, the
+// sidecar index is compared with the rebuilt offsets, and the segments are checked to be
+// contiguous. Problems are reported in the returned VerifyReport, the error is only set if
+// the verification itself couldn't be completed, e.g. because ctx was cancelled. Verify
+// can be run on a log that's in use, the log's read lock is held while each segment is
+// verified.
+func (log *Log) Verify(ctx context.Context, opts VerifyOptions) (VerifyReport, error) {
+	if opts.Keys == nil {
+		opts.Keys = log.config.Keys
+	}
+	log.lock.RLock()
+	if log.closed {
+		log.lock.RUnlock()
+		return VerifyReport{}, ErrLogClosed
+	}
+	firsts := make([]Index, len(log.items))
+	for i, s := range log.items {
+		firsts[i] = s.firstIndex
+	}
+	log.lock.RUnlock()
+
+	var report VerifyReport
+	for _, first := range firsts {
+		rep, found, err := log.verifySegment(ctx, first, &opts)
+		if err != nil {
+			return report, err
+		}
+		if found {
+			report.Segments = append(report.Segments, rep)
+		}
+	}
+	report.Gaps = segmentGaps(report.Segments)
+	return report, nil
+}
+
+// verifySegment verifies the segment starting at first, if its still in the log.
+func (log *Log) verifySegment(ctx context.Context, first Index, opts *VerifyOptions) (SegmentReport, bool, error) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	if log.closed {
+		return SegmentReport{}, false, ErrLogClosed
+	}
+	i := sort.Search(len(log.items), func(i int) bool {
+		return log.items[i].firstIndex >= first
+	})
+	if i == len(log.items) || log.items[i].firstIndex != first {
+		// removed since Verify started
+		return SegmentReport{}, false, nil
+	}
+	seg := log.items[i]
+	limit := int64(-1)
+	if w := log.writer; w != nil && seg == &w.reader {
+		// don't read past what's been published, as there may be a write in progress.
+		limit = w.fileSize
+	}
+	rep, err := verifySegmentFile(ctx, log.dir, seg.filename, limit, opts)
+	return rep, true, err
+}
+
+// VerifyDir verifies the log in dir like Log.Verify, but without opening it, so it can
+// report problems that would stop the log from being opened. The log shouldn't be open
+// for writing while its verified.
+func VerifyDir(ctx context.Context, dir string, opts VerifyOptions) (VerifyReport, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[f.Name()] = true
+	}
+	var report VerifyReport
+	for _, f := range files {
+		if f.IsDir() || !isSegmentFile(f.Name()) || names[f.Name()+"z"] {
+			// a segment with a block compressed copy is removed when the log is opened.
+			continue
+		}
+		rep, err := verifySegmentFile(ctx, dir, f.Name(), -1, &opts)
+		if err != nil {
+			return report, err
+		}
+		report.Segments = append(report.Segments, rep)
+	}
+	sort.SliceStable(report.Segments, func(a, b int) bool {
+		return report.Segments[a].FirstIndex < report.Segments[b].FirstIndex
+	})
+	report.Gaps = segmentGaps(report.Segments)
+	return report, nil
+}
+
+// segmentGaps returns where the segments in reports, sorted by their first index, aren't
+// contiguous. Segments that couldn't be read or have no entries are ignored.
+func segmentGaps(reports []SegmentReport) []SegmentGap {
+	var gaps []SegmentGap
+	var prev *SegmentReport
+	for i := range reports {
+		r := &reports[i]
+		if r.FirstIndex == 0 || r.LastIndex < r.FirstIndex {
+			continue
+		}
+		if prev != nil && r.FirstIndex != prev.LastIndex+1 {
+			gaps = append(gaps, SegmentGap{Prev: prev.Segment, PrevLast: prev.LastIndex, Next: r.Segment, NextFirst: r.FirstIndex})
+		}
+		prev = r
+	}
+	return gaps
+}
+
+// verifySegmentFile verifies the segment filename in dir. If limit isn't -1, only the
+// first limit bytes of the file are verified. The error is only set if ctx is done.
+func verifySegmentFile(ctx context.Context, dir, filename string, limit int64, opts *VerifyOptions) (SegmentReport, error) {
+	rep := SegmentReport{Segment: filename}
+	first, last, err := parseSegmentFilename(filename)
+	if err != nil {
+		rep.Err = fmt.Errorf("Segment %v has an invalid filename: %v", filename, err)
+		return rep, nil
+	}
+	rep.FirstIndex, rep.LastIndex = first, last
+	f, err := os.Open(path.Join(dir, filename))
+	if err != nil {
+		rep.Err = err
+		return rep, nil
+	}
+	defer f.Close()
+	if limit < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			rep.Err = err
+			return rep, nil
+		}
+		limit = info.Size()
+	}
+	rep.Size = limit
+	s := &segmentReader{
+		dir:        dir,
+		filename:   filename,
+		config:     &Config{ReadOnly: true, Keys: opts.Keys},
+		firstIndex: first,
+		lastIndex:  last,
+		f:          f,
+	}
+	if s.header, err = readSegmentHeader(f, filename, first); err != nil {
+		rep.Err = err
+		return rep, nil
+	}
+	if s.checksum, err = checksumFor(s.header.checksum); err != nil {
+		rep.Err = err
+		return rep, nil
+	}
+	if opts.Decode {
+		if s.aead, err = segmentCipherFor(&s.header, opts.Keys); err != nil {
+			rep.Err = fmt.Errorf("Segment %v can't be decrypted: %v", filename, err)
+			return rep, nil
+		}
+	}
+	if s.compressed() {
+		err = s.verifyBlocks(ctx, &rep, opts.Decode)
+	} else {
+		err = s.verifyFrames(ctx, &rep, limit, opts.Decode)
+	}
+	return rep, err
+}
+
+// verifyFrame checks the frame of the entry at idx.
+func (s *segmentReader) verifyFrame(idx Index, offset int64, body []byte, decode bool) error {
+	if decode {
+		_, _, err := s.decodeFrame(idx, offset, body)
+		return err
+	}
+	if _, _, err := s.checkFrame(body); err != nil {
+		return s.corruptEntry(idx, offset, err)
+	}
+	return nil
+}
+
+// verifyFrames checks each frame in the first size bytes of a regular segment, and that
+// they match the filename and sidecar index.
+func (s *segmentReader) verifyFrames(ctx context.Context, rep *SegmentReport, size int64, decode bool) error {
+	offset := s.header.size
+	r := bufio.NewReader(io.NewSectionReader(s.f, offset, size-offset))
+	offsets := make([]int64, 0, 32)
+	var body []byte
+	var scratch [4]byte
+	for offset < size {
+		idx := s.firstIndex + Index(len(offsets))
+		if len(offsets)%verifyCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if s.sealed() && idx > s.lastIndex {
+			rep.BadIndex = idx
+			rep.Err = fmt.Errorf("Segment %v has unexpected data after its last entry at offset %d", s.filename, offset)
+			rep.goodSize = offset
+			return nil
+		}
+		if offset+4 > size {
+			rep.BadIndex = idx
+			rep.Err = s.corruptEntry(idx, offset, errPastEnd)
+			break
+		}
+		if _, err := io.ReadFull(r, scratch[:]); err != nil {
+			rep.Err = err
+			return nil
+		}
+		fsize := int64(frameSize(s.header.version, int(binary.LittleEndian.Uint32(scratch[:]))))
+		if offset+fsize > size {
+			rep.BadIndex = idx
+			rep.Err = s.corruptEntry(idx, offset, errPastEnd)
+			break
+		}
+		if int64(cap(body)) < fsize-4 {
+			body = make([]byte, fsize-4)
+		}
+		body = body[:fsize-4]
+		if _, err := io.ReadFull(r, body); err != nil {
+			rep.Err = err
+			return nil
+		}
+		if err := s.verifyFrame(idx, offset, body, decode); err != nil {
+			rep.BadIndex = idx
+			rep.Err = err
+			break
+		}
+		offsets = append(offsets, offset)
+		offset += fsize
+	}
+	rep.goodSize = offset
+	if !s.sealed() {
+		rep.LastIndex = s.firstIndex + Index(len(offsets)) - 1
+		return nil
+	}
+	if rep.Err != nil {
+		return nil
+	}
+	if count := Index(len(offsets)); count != s.lastIndex-s.firstIndex+1 {
+		rep.BadIndex = s.firstIndex + count
+		rep.Err = fmt.Errorf("Segment %v has %d entries, its filename says it has %d", s.filename, count, s.lastIndex-s.firstIndex+1)
+		return nil
+	}
+	sidecar, _, err := readIndexFile(path.Join(s.dir, indexFilename(s.filename)), size)
+	if err == nil && !equalOffsets(sidecar, offsets) {
+		rep.BadSidecar = true
+	}
+	return nil
+}
+
+func equalOffsets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyBlocks checks the block index and each frame of a block compressed segment.
+func (s *segmentReader) verifyBlocks(ctx context.Context, rep *SegmentReport, decode bool) error {
+	if !s.sealed() || s.lastIndex < s.firstIndex {
+		rep.Err = fmt.Errorf("Segment %v is block compressed but isn't sealed", s.filename)
+		return nil
+	}
+	if err := s.readBlockIndex(); err != nil {
+		rep.Err = err
+		return nil
+	}
+	for idx := s.firstIndex; idx <= s.lastIndex; idx++ {
+		if (idx-s.firstIndex)%verifyCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		body, offset, err := s.blockFrame(idx)
+		if err == nil {
+			err = s.verifyFrame(idx, offset, body, decode)
+		}
+		if err != nil {
+			rep.BadIndex = idx
+			rep.Err = err
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package raftylog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+// corruptByte flips the bits of the byte at offset in a segment file.
+func corruptByte(t *testing.T, filename string, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := []byte{0}
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LogVerify(t *testing.T) {
+	configs := map[string]Config{
+		"plain":      {MaxSegmentItems: 10},
+		"blocks":     {MaxSegmentItems: 10, SegmentCompression: CompressionS2, SegmentBlockSize: 256},
+		"encryption": {MaxSegmentItems: 10, Encryption: EncryptionAESGCM, Keys: testKeys("a", "a"), Compression: CompressionS2},
+	}
+	for name, cfg := range configs {
+		cfg := cfg
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testDir(t)
+			defer cleanup()
+			log, err := Open(dir, &cfg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			if _, _, err := log.AppendBatch(testEntries(35)); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SegmentCompression != CompressionNone {
+				waitFor(t, func() bool { return compressedSegments(log) == 3 })
+			}
+			report, err := log.Verify(context.Background(), VerifyOptions{Decode: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.OK() || len(report.Segments) != 4 {
+				t.Fatalf("Unexpected report %+v", report)
+			}
+			if s := report.Segments[3]; s.FirstIndex != 31 || s.LastIndex != 35 {
+				t.Errorf("Unexpected report for writer segment %+v", s)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := log.Verify(ctx, VerifyOptions{}); err != context.Canceled {
+				t.Errorf("Expecting cancelled verify to fail, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_LogVerifyCorrupt(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10}, testEntries(45))
+	log, err := Open(dir, &Config{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := log.items[1]
+	if err := seg.loadOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	corruptByte(t, path.Join(dir, seg.filename), seg.offsets[4]+6)
+	// entries 11-20 are the same size as 31-40, so this is the offset of entry 34
+	truncateAt := seg.offsets[3]
+	report, err := log.Verify(context.Background(), VerifyOptions{})
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := report.Segments[1]
+	if report.OK() || s.BadIndex != 15 || !errors.Is(s.Err, ErrCorruptEntry) {
+		t.Errorf("Expecting entry 15 to be corrupt, got %+v", s)
+	}
+
+	// a missing segment & a segment with fewer entries than its filename says
+	if err := os.Remove(path.Join(dir, "00000000000000000021-00000000000000000030.seg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path.Join(dir, "00000000000000000031-00000000000000000040.seg"), truncateAt); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyDir(context.Background(), dir, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Segments) != 4 || len(report.Gaps) != 1 || report.Gaps[0].PrevLast != 20 || report.Gaps[0].NextFirst != 31 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if s := report.Segments[2]; s.BadIndex != 34 || s.Err == nil {
+		t.Errorf("Expecting truncated segment to be reported, got %+v", s)
+	}
+	if s := report.Segments[3]; !s.OK() || s.FirstIndex != 41 || s.LastIndex != 45 {
+		t.Errorf("Unexpected report for last segment %+v", s)
+	}
+}
+
+func Test_VerifyDirEncrypted(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+	writeTestLog(t, dir, &Config{MaxSegmentItems: 10, Encryption: EncryptionChaCha20Poly1305, Keys: testKeys("a", "a")}, testEntries(15))
+	// the hashes can be checked without the keys
+	report, err := VerifyDir(context.Background(), dir, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	report, err = VerifyDir(context.Background(), dir, VerifyOptions{Decode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Segments[0].Err == nil {
+		t.Errorf("Decoding without keys should fail, got %+v", report)
+	}
+	report, err = VerifyDir(context.Background(), dir, VerifyOptions{Decode: true, Keys: testKeys("a", "a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}